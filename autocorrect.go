@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Autocorrect settings decide what the hook does with an unknown token
+// that is close to a key.
+const (
+	// autocorrectOff leaves unknown tokens alone.
+	autocorrectOff = "off"
+	// autocorrectApply replaces the token when a single key is close.
+	autocorrectApply = "apply"
+	// autocorrectPrompt asks on the terminal before replacing the token.
+	autocorrectPrompt = "prompt"
+	// autocorrectFail rejects the message, naming the close keys.
+	autocorrectFail = "fail"
+)
+
+func (p Policy) autocorrect() string {
+	if p.Autocorrect == "" {
+		return autocorrectOff
+	}
+	return p.Autocorrect
+}
+
+// editDistance returns the number of insertions, deletions, substitutions
+// and swaps of neighbouring bytes it takes to turn a into b.
+func editDistance(a, b string) int {
+	prev2 := make([]int, len(b)+1)
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d := prev[j-1] + cost
+			if prev[j]+1 < d {
+				d = prev[j] + 1
+			}
+			if cur[j-1]+1 < d {
+				d = cur[j-1] + 1
+			}
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] && prev2[j-2]+1 < d {
+				d = prev2[j-2] + 1
+			}
+			cur[j] = d
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return prev[len(b)]
+}
+
+// maxDistance is how far a token may be from key to be suggested for it:
+// one edit for short keys, two for longer ones.
+func maxDistance(key string) int {
+	if len(key) <= 4 {
+		return 1
+	}
+	return 2
+}
+
+// suggestKeys returns the keys closest to the unknown token text, compared
+// in their normalized forms, in alphabetical order.
+func suggestKeys(cfg *Config, token string) []string {
+	match := cfg.Policy.match()
+	form := normalizeKey(match, token)
+	best := -1
+	var keys []string
+	for key := range cfg.Words {
+		d := editDistance(form, normalizeKey(match, key))
+		if d > maxDistance(key) || best >= 0 && d > best {
+			continue
+		}
+		if d < best || best < 0 {
+			best, keys = d, nil
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// openTTY opens the terminal for prompts. It fails when there is none, as
+// when git runs without one.
+var openTTY = func() (io.ReadWriteCloser, error) {
+	return os.OpenFile("/dev/tty", os.O_RDWR, 0)
+}
+
+// confirm asks on the terminal whether to replace token with key. It
+// returns false without asking when there is no terminal.
+func confirm(token, key string) (answer, asked bool) {
+	tty, err := openTTY()
+	if err != nil {
+		return false, false
+	}
+	defer tty.Close()
+	fmt.Fprintf(tty, "lipstick: replace %s with :%s:? [Y/n] ", token, key)
+	line, _ := bufio.NewReader(tty).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(line)) {
+	case "", "y", "yes":
+		return true, true
+	}
+	return false, true
+}
+
+// didYouMean lists keys as tokens for a suggestion.
+func didYouMean(keys []string) string {
+	tokens := make([]string, len(keys))
+	for i, key := range keys {
+		tokens[i] = ":" + key + ":"
+	}
+	if len(tokens) == 1 {
+		return tokens[0]
+	}
+	return strings.Join(tokens[:len(tokens)-1], ", ") + " or " + tokens[len(tokens)-1]
+}
+
+// bodyTokens returns where the tokens in the lines of msg that git keeps
+// are, leaving out comments and everything below a scissors line.
+func bodyTokens(msg string) [][]int {
+	_, numbers := messageBody(msg)
+	kept := map[int]bool{}
+	for _, n := range numbers {
+		kept[n] = true
+	}
+	var locs [][]int
+	offset := 0
+	for n, l := range strings.Split(msg, "\n") {
+		if kept[n] {
+			for _, loc := range tokenPattern.FindAllStringIndex(l, -1) {
+				locs = append(locs, []int{offset + loc[0], offset + loc[1]})
+			}
+		}
+		offset += len(l) + 1
+	}
+	return locs
+}
+
+// autocorrect handles the unknown tokens in msg that are close to a key
+// the way the [policy] autocorrect setting says, logging every correction.
+// Tokens that are a mapped value are known and left alone, as are those in
+// comments or below a scissors line, which git throws away.
+func autocorrect(cfg *Config, msg string) (string, error) {
+	mode := cfg.Policy.autocorrect()
+	if mode == autocorrectOff {
+		return msg, nil
+	}
+	known := map[string]bool{}
+	for _, value := range cfg.Words {
+		known[value] = true
+	}
+	var b strings.Builder
+	last := 0
+	for _, loc := range bodyTokens(msg) {
+		token := msg[loc[0]:loc[1]]
+		if _, ok := cfg.lookup(token[1 : len(token)-1]); ok || known[token] {
+			continue
+		}
+		keys := suggestKeys(cfg, token[1:len(token)-1])
+		if len(keys) == 0 {
+			continue
+		}
+		if mode == autocorrectFail {
+			return "", &cliError{exitRejected, fmt.Errorf("unknown token %s, did you mean %s?", token, didYouMean(keys))}
+		}
+		fix := len(keys) == 1
+		if fix && mode == autocorrectPrompt {
+			var asked bool
+			if fix, asked = confirm(token, keys[0]); !asked {
+				log.Printf("warning: unknown token %s, did you mean %s?", token, didYouMean(keys))
+				continue
+			}
+		}
+		if !fix {
+			if len(keys) > 1 {
+				log.Printf("warning: unknown token %s, did you mean %s?", token, didYouMean(keys))
+			}
+			continue
+		}
+		log.Printf("corrected %s to :%s:", token, keys[0])
+		b.WriteString(msg[last:loc[0]])
+		b.WriteString(":" + keys[0] + ":")
+		last = loc[1]
+	}
+	b.WriteString(msg[last:])
+	return b.String(), nil
+}
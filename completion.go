@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/codegangsta/cli"
+)
+
+// partialToken returns where the token still being typed at the end of
+// word starts, at one of the delimiters in tables, or -1.
+func partialToken(tables map[byte]*Config, word string) int {
+	i := len(word)
+	for i > 0 && isKeyByte(word[i-1]) {
+		i--
+	}
+	if i == 0 || tables[word[i-1]] == nil {
+		return -1
+	}
+	return i - 1
+}
+
+// completionTables returns commitKinds and the other tables of cfg by
+// their delimiter.
+func completionTables(cfg *Config) map[byte]*Config {
+	tables := cfg.delimitedTables()
+	tables[':'] = cfg
+	return tables
+}
+
+// completeKeys returns the tokens that complete word, of commitKinds or of
+// the table whose delimiter opens the partial token. Keys are matched under
+// the match policy. Everything before the partial token is kept so the
+// result can replace the whole word, minus any opening quote the shell has
+// not stripped.
+func completeKeys(cfg *Config, word string) []string {
+	word = strings.TrimLeft(word, `"'`)
+	tables := completionTables(cfg)
+	prefix, partial, d := "", "", byte(':')
+	if i := partialToken(tables, word); i >= 0 {
+		prefix, partial, d = word[:i], word[i+1:], word[i]
+	} else if word != "" {
+		return nil
+	}
+	match := cfg.Policy.match()
+	form := normalizeKey(match, partial)
+	keys := []string{}
+	for key := range tables[d].Words {
+		if strings.HasPrefix(normalizeKey(match, key), form) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	out := make([]string, len(keys))
+	for i, key := range keys {
+		out[i] = prefix + string(d) + key + string(d)
+	}
+	return out
+}
+
+// printKeyCompletions is called by the completion scripts while a message
+// is being typed.
+func printKeyCompletions(dir, word string, describe bool) error {
+	cfg, err := loadEmojiMap(dir)
+	if err != nil {
+		return err
+	}
+	tables := completionTables(cfg)
+	for _, c := range completeKeys(cfg, word) {
+		if describe {
+			d := c[len(c)-1]
+			key := c[strings.LastIndexByte(c[:len(c)-1], d)+1 : len(c)-1]
+			fmt.Printf("%s\t%s\n", c, tables[d].Words[key])
+		} else {
+			fmt.Println(c)
+		}
+	}
+	return nil
+}
+
+// commandNames returns every name and alias of the app's commands.
+func commandNames(app *cli.App) []string {
+	var names []string
+	for _, c := range app.Commands {
+		names = append(names, c.Names()...)
+	}
+	return names
+}
+
+// completionScripts maps each supported shell to its script generator.
+var completionScripts = map[string]func(io.Writer, *cli.App){
+	"bash": bashCompletion,
+	"zsh":  zshCompletion,
+	"fish": fishCompletion,
+}
+
+// writeCompletion prints the completion script for shell.
+func writeCompletion(app *cli.App, shell string) error {
+	gen, ok := completionScripts[shell]
+	if !ok {
+		return usageErrorf("unsupported shell %q, use bash, zsh or fish", shell)
+	}
+	gen(os.Stdout, app)
+	return nil
+}
+
+func bashCompletion(w io.Writer, app *cli.App) {
+	fmt.Fprintf(w, `# lipstick bash completion, load with: source <(lipstick completion bash)
+_lipstick() {
+	local cur="${COMP_WORDS[COMP_CWORD]}"
+	if [ "$COMP_CWORD" -eq 1 ]; then
+		COMPREPLY=( $(compgen -W %q -- "$cur") )
+	fi
+}
+complete -o default -F _lipstick lipstick
+
+# Complete :key: and other table tokens in git commit -m messages. git's
+# own completion is loaded first so its _git_commit can be wrapped rather
+# than replaced.
+_lipstick_keys() {
+	local word="${1##* }" reply colon_prefix
+	word="${word#[\"\']}"
+	case "$word" in
+	*[[:punct:]]*) ;;
+	*) return 1 ;;
+	esac
+	reply=$(lipstick complete-keys -- "$word" 2>/dev/null) || return 1
+	[ -n "$reply" ] || return 1
+	COMPREPLY=( $reply )
+	# readline treats ':' as a word break, so only the text after the last
+	# colon of the word is replaced.
+	if [[ "$COMP_WORDBREAKS" == *:* ]]; then
+		colon_prefix=${word%%"${word##*:}"}
+		COMPREPLY=( "${COMPREPLY[@]#"$colon_prefix"}" )
+	fi
+	compopt -o nospace 2>/dev/null
+	return 0
+}
+if ! declare -F _git_commit >/dev/null; then
+	if declare -F _comp_load >/dev/null; then
+		_comp_load git
+	elif declare -F _completion_loader >/dev/null; then
+		_completion_loader git
+	fi
+fi
+if declare -F _git_commit >/dev/null; then
+	eval "$(declare -f _git_commit | sed '1s/_git_commit/_lipstick_orig_git_commit/')"
+	_git_commit() {
+		_lipstick_keys "$cur" || _lipstick_orig_git_commit "$@"
+	}
+fi
+`, strings.Join(commandNames(app), " "))
+}
+
+func zshCompletion(w io.Writer, app *cli.App) {
+	fmt.Fprintln(w, "#compdef lipstick")
+	fmt.Fprintln(w, "# lipstick zsh completion, load with: source <(lipstick completion zsh)")
+	fmt.Fprintln(w, "_lipstick() {")
+	fmt.Fprintln(w, "\tlocal -a commands")
+	fmt.Fprintln(w, "\tcommands=(")
+	for _, c := range app.Commands {
+		for _, name := range c.Names() {
+			fmt.Fprintf(w, "\t\t%s\n", shellQuote(name+":"+c.Usage))
+		}
+	}
+	fmt.Fprintln(w, "\t)")
+	fmt.Fprintln(w, "\tif (( CURRENT == 2 )); then")
+	fmt.Fprintln(w, "\t\t_describe command commands")
+	fmt.Fprintln(w, "\telse")
+	fmt.Fprintln(w, "\t\t_files")
+	fmt.Fprintln(w, "\tfi")
+	fmt.Fprintln(w, "}")
+	fmt.Fprintln(w, "compdef _lipstick lipstick")
+	fmt.Fprint(w, `
+# Complete :key: and other table tokens in git commit messages by running
+# before the normal completers.
+_lipstick_keys() {
+	[[ ${words[1]} == git && ${words[(i)commit]} -le ${#words} ]] || return 1
+	[[ ${PREFIX##*[[:space:]]} == *[[:punct:]]* ]] || return 1
+	local -a tokens
+	tokens=(${(f)"$(lipstick complete-keys -- "${PREFIX##*[[:space:]]}" 2>/dev/null)"})
+	(( ${#tokens} )) || return 1
+	compset -P '*[[:space:]]'
+	compadd -Q -S '' -- $tokens
+}
+() {
+	local -a completers
+	zstyle -a ':completion:*' completer completers
+	(( ${#completers} )) || completers=(_complete _ignored)
+	(( ${completers[(I)_lipstick_keys]} )) || zstyle ':completion:*' completer _lipstick_keys $completers
+}
+`)
+}
+
+func fishCompletion(w io.Writer, app *cli.App) {
+	fmt.Fprintln(w, "# lipstick fish completion, load with: lipstick completion fish | source")
+	fmt.Fprintln(w, "complete -c lipstick -f")
+	for _, c := range app.Commands {
+		for _, name := range c.Names() {
+			fmt.Fprintf(w, "complete -c lipstick -n __fish_use_subcommand -a %s -d %s\n", shellQuote(name), shellQuote(c.Usage))
+		}
+	}
+	fmt.Fprint(w, `
+# Complete :key: and other table tokens in git commit messages.
+complete -c git -n '__fish_seen_subcommand_from commit; and string match -qr -- "[[:punct:]][A-Za-z0-9_+-]*$" (commandline -ct)' -f -a '(lipstick complete-keys --describe -- (commandline -ct) 2>/dev/null)'
+`)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/codegangsta/cli"
+	"github.com/jesusrmoreno/lipstick/internal/git"
+)
+
+// Exit codes, documented in the Readme.
+const (
+	exitOK       = 0
+	exitFailure  = 1 // anything not covered below
+	exitUsage    = 2 // missing or bad arguments
+	exitConfig   = 3 // a config file could not be read or decoded
+	exitNoRepo   = 4 // not in a repository lipstick supports
+	exitIO       = 5 // a file could not be read or written
+	exitRejected = 6 // the message breaks the rules of its kind
+)
+
+// errorKinds names the exit codes in --json output.
+var errorKinds = map[int]string{
+	exitFailure:  "failure",
+	exitUsage:    "usage",
+	exitConfig:   "config",
+	exitNoRepo:   "repository",
+	exitIO:       "io",
+	exitRejected: "rejected",
+}
+
+// cliError is an error with the exit code it ends lipstick with.
+type cliError struct {
+	code int
+	err  error
+}
+
+func (e *cliError) Error() string { return e.err.Error() }
+func (e *cliError) Unwrap() error { return e.err }
+
+func usageErrorf(format string, args ...interface{}) error {
+	return &cliError{exitUsage, fmt.Errorf(format, args...)}
+}
+
+func configError(err error) error {
+	return &cliError{exitConfig, fmt.Errorf("could not load config: %v", err)}
+}
+
+func ioError(err error) error {
+	return &cliError{exitIO, err}
+}
+
+// errRejected is returned for a message that breaks the rules of its kind.
+var errRejected = &cliError{exitRejected, errors.New("the message does not follow the rules of its kind")}
+
+// exitCodeOf returns the exit code for err. Errors from the standard
+// library and the git package are classified by their type, and several
+// errors joined together exit with the highest code among them.
+func exitCodeOf(err error) int {
+	if errs, ok := err.(interface{ Unwrap() []error }); ok {
+		code := exitOK
+		for _, e := range errs.Unwrap() {
+			if c := exitCodeOf(e); c > code {
+				code = c
+			}
+		}
+		return code
+	}
+	var ce *cliError
+	var pe *os.PathError
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.As(err, &ce):
+		return ce.code
+	case errors.Is(err, errNoRepository), errors.Is(err, git.ErrNotRepository):
+		return exitNoRepo
+	case errors.As(err, &pe):
+		return exitIO
+	}
+	return exitFailure
+}
+
+// jsonErrors is set by the global --json flag.
+var jsonErrors bool
+
+// report prints err to stderr, as one JSON object per error with --json,
+// and returns its exit code.
+func report(err error) int {
+	if errs, ok := err.(interface{ Unwrap() []error }); ok {
+		for _, e := range errs.Unwrap() {
+			report(e)
+		}
+		return exitCodeOf(err)
+	}
+	code := exitCodeOf(err)
+	if jsonErrors {
+		json.NewEncoder(os.Stderr).Encode(struct {
+			Error string `json:"error"`
+			Kind  string `json:"kind"`
+			Code  int    `json:"code"`
+		}{err.Error(), errorKinds[code], code})
+	} else {
+		fmt.Fprintln(os.Stderr, "fatal:", err)
+	}
+	return code
+}
+
+// run adapts an operation to a cli action, ending lipstick with the exit
+// code of the error it returns. In a dry run the changes the operation
+// would have made are printed first.
+func run(f func(c *cli.Context) error) func(*cli.Context) {
+	return func(c *cli.Context) {
+		err := f(c)
+		if dryRun != nil {
+			printDryRun(os.Stdout)
+		}
+		if err != nil {
+			os.Exit(report(err))
+		}
+	}
+}
+
+// verbose is set by the global --verbose flag.
+var verbose bool
+
+// applyGlobalFlags is run before every command. Messages are logged
+// without timestamps unless verbose is set; quiet drops everything but
+// errors. In a dry run they are marked as such.
+func applyGlobalFlags(c *cli.Context) error {
+	if c.GlobalBool("dry-run") {
+		dryRun = map[string]*string{}
+		log.SetPrefix("dry run: ")
+	}
+	jsonErrors = c.GlobalBool("json")
+	verbose = c.GlobalBool("verbose")
+	var w io.Writer = os.Stderr
+	if c.GlobalBool("quiet") {
+		if verbose {
+			return usageErrorf("--quiet and --verbose cannot be used together")
+		}
+		w = ioutil.Discard
+	}
+	log.SetOutput(w)
+	if verbose {
+		log.SetFlags(log.LstdFlags)
+	} else {
+		log.SetFlags(0)
+	}
+	return nil
+}
+
+// debugf logs only with --verbose.
+func debugf(format string, args ...interface{}) {
+	if verbose {
+		log.Printf(format, args...)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/jesusrmoreno/lipstick/internal/git"
+)
+
+// gitPrefix marks an extends entry that is read from the object store of
+// the repository, as git:<rev>:<path>.
+const gitPrefix = "git:"
+
+// configLocation is where a config file is read from: a file on disk or,
+// when rev is set, a path at a revision of the repository containing dir.
+type configLocation struct {
+	dir  string
+	rev  string
+	path string
+}
+
+func (l configLocation) String() string {
+	if l.rev != "" {
+		return gitPrefix + l.rev + ":" + l.path
+	}
+	return l.path
+}
+
+// resolve returns the location of an extends entry of the file at l.
+// Relative paths are relative to the directory of that file, at the same
+// revision when it came from git.
+func (l configLocation) resolve(entry string) (configLocation, error) {
+	if strings.HasPrefix(entry, gitPrefix) {
+		spec := entry[len(gitPrefix):]
+		i := strings.Index(spec, ":")
+		if i <= 0 || i == len(spec)-1 {
+			return configLocation{}, fmt.Errorf("%s: extends %q: want git:<rev>:<path>", l, entry)
+		}
+		return configLocation{dir: l.dir, rev: spec[:i], path: path.Clean(strings.TrimPrefix(spec[i+1:], "/"))}, nil
+	}
+	if filepath.IsAbs(entry) {
+		return configLocation{dir: l.dir, path: filepath.Clean(entry)}, nil
+	}
+	if l.rev != "" {
+		return configLocation{dir: l.dir, rev: l.rev, path: path.Join(path.Dir(l.path), filepath.ToSlash(entry))}, nil
+	}
+	return configLocation{dir: l.dir, path: filepath.Join(filepath.Dir(l.path), entry)}, nil
+}
+
+func (l configLocation) read() ([]byte, error) {
+	if l.rev == "" {
+		return ioutil.ReadFile(l.path)
+	}
+	repo, err := git.OpenDir(l.dir)
+	if err != nil {
+		return nil, err
+	}
+	h, err := repo.Resolve(l.rev)
+	if err != nil {
+		return nil, err
+	}
+	return repo.File(h, l.path)
+}
+
+// decoderFor picks the decoder for a file from its name, falling back on
+// TOML like .lipstickrc.
+func decoderFor(name string) func([]byte, *Config) (bool, error) {
+	base := path.Base(filepath.ToSlash(name))
+	for _, f := range localConfigFiles {
+		if f.name == base {
+			return f.decode
+		}
+	}
+	switch path.Ext(base) {
+	case ".yaml", ".yml":
+		return decodeYAML
+	case ".json":
+		return decodeJSON
+	}
+	return decodeTOML
+}
+
+// readConfigFile decodes the config at l with everything it extends merged
+// in first, in order. stack holds the files that led here, to report cycles
+// and which file extended a missing one. The bool is false when the file
+// exists but has no lipstick config.
+func readConfigFile(l configLocation, decode func([]byte, *Config) (bool, error), stack []string) (*Config, bool, error) {
+	name := l.String()
+	for i, s := range stack {
+		if s == name {
+			return nil, false, fmt.Errorf("extends cycle: %s -> %s", strings.Join(stack[i:], " -> "), name)
+		}
+	}
+	data, err := l.read()
+	if err != nil {
+		if len(stack) > 0 {
+			return nil, false, fmt.Errorf("%s: extends %s: %v", stack[len(stack)-1], name, err)
+		}
+		return nil, false, err
+	}
+	file := &Config{}
+	found, err := decode(data, file)
+	if err != nil {
+		return nil, false, fmt.Errorf("%s: %v", name, err)
+	} else if !found {
+		return nil, false, nil
+	}
+	file.setSource(name)
+
+	cfg := &Config{}
+	for _, entry := range file.Extends {
+		el, err := l.resolve(entry)
+		if err != nil {
+			return nil, false, err
+		}
+		base, found, err := readConfigFile(el, decoderFor(el.path), append(stack, name))
+		if err != nil {
+			return nil, false, err
+		} else if !found {
+			return nil, false, fmt.Errorf("%s: extends %s, which has no lipstick config", name, el)
+		}
+		cfg.merge(base)
+	}
+	cfg.merge(file)
+	return cfg, true, nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/natefinch/atomic"
+)
+
+// Every change lipstick makes to files goes through the functions below so
+// the global --dry-run flag can hold the changes back and show them as a
+// diff instead. Later reads see the held back changes, so a dry run takes
+// the same decisions a real one would.
+
+// dryRun holds the planned content of every file a dry run touched, nil
+// for files that would be removed. It is nil outside of dry runs.
+var dryRun map[string]*string
+
+func dryRunKey(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return filepath.Clean(path)
+}
+
+// readFile is ioutil.ReadFile seeing the changes of a dry run.
+func readFile(path string) ([]byte, error) {
+	if c, ok := dryRun[dryRunKey(path)]; ok {
+		if c == nil {
+			return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+		}
+		return []byte(*c), nil
+	}
+	return ioutil.ReadFile(path)
+}
+
+// writeFile replaces the file at path atomically, creating its directory
+// if needed. An existing file keeps its mode.
+func writeFile(path, data string) error {
+	debugf("writing %s", path)
+	if dryRun != nil {
+		dryRun[dryRunKey(path)] = &data
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return atomic.WriteFile(path, strings.NewReader(data))
+}
+
+func chmod(path string, mode os.FileMode) error {
+	if dryRun != nil {
+		return nil
+	}
+	return os.Chmod(path, mode)
+}
+
+func mkdirAll(path string) error {
+	if dryRun != nil {
+		return nil
+	}
+	return os.MkdirAll(path, 0755)
+}
+
+func removeFile(path string) error {
+	debugf("removing %s", path)
+	if dryRun != nil {
+		if _, err := readFile(path); err != nil {
+			return err
+		}
+		dryRun[dryRunKey(path)] = nil
+		return nil
+	}
+	return os.Remove(path)
+}
+
+func renameFile(from, to string) error {
+	debugf("moving %s to %s", from, to)
+	if dryRun != nil {
+		data, err := readFile(from)
+		if err != nil {
+			return err
+		}
+		s := string(data)
+		dryRun[dryRunKey(to)] = &s
+		dryRun[dryRunKey(from)] = nil
+		return nil
+	}
+	return os.Rename(from, to)
+}
+
+// removeAll removes path and everything below it.
+func removeAll(path string) error {
+	debugf("removing %s", path)
+	if dryRun != nil {
+		root := dryRunKey(path)
+		filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+			if err == nil && !fi.IsDir() {
+				dryRun[p] = nil
+			}
+			return nil
+		})
+		for p := range dryRun {
+			if p == root || strings.HasPrefix(p, root+string(filepath.Separator)) {
+				dryRun[p] = nil
+			}
+		}
+		return nil
+	}
+	return os.RemoveAll(path)
+}
+
+// readDirNames lists the files in dir, seeing the changes of a dry run.
+func readDirNames(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	names := map[string]bool{}
+	for _, fi := range infos {
+		names[fi.Name()] = true
+	}
+	root := dryRunKey(dir)
+	for p, c := range dryRun {
+		if filepath.Dir(p) == root {
+			names[filepath.Base(p)] = c != nil
+		}
+	}
+	var list []string
+	for name, ok := range names {
+		if ok {
+			list = append(list, name)
+		}
+	}
+	sort.Strings(list)
+	return list, nil
+}
+
+// inDir resolves path against dir, the working directory of a command.
+func inDir(dir, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// maxDiffLines bounds the files shown as a diff, the diff is quadratic.
+const maxDiffLines = 1 << 12
+
+// printDryRun writes a unified diff of every file the dry run would
+// change. Files inside the working directory are named relative to it as
+// a/ and b/ paths, others by their absolute path.
+func printDryRun(w io.Writer) {
+	paths := make([]string, 0, len(dryRun))
+	for p := range dryRun {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		old, err := ioutil.ReadFile(p)
+		existed := err == nil
+		planned := dryRun[p]
+		if !existed && planned == nil || planned != nil && existed && *planned == string(old) {
+			continue
+		}
+		from, to, content := p, p, ""
+		if rel, err := filepath.Rel(pwd, p); err == nil && !strings.HasPrefix(rel, "..") {
+			from, to = "a/"+rel, "b/"+rel
+		}
+		if !existed {
+			from = "/dev/null"
+		}
+		if planned == nil {
+			to = "/dev/null"
+		} else {
+			content = *planned
+		}
+		if len(splitLines(string(old))) > maxDiffLines || len(splitLines(content)) > maxDiffLines {
+			fmt.Fprintf(w, "Files %s and %s differ\n", from, to)
+			continue
+		}
+		if content == "" && string(old) == "" {
+			// Creating or removing an empty file has no lines to show.
+			fmt.Fprintf(w, "--- %s\n+++ %s\n", from, to)
+			continue
+		}
+		fmt.Fprint(w, unifiedDiff(from, to, string(old), content))
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// errNoLocalConfig is returned by loadLocalConfig when the repository has
+// no config in any of the supported files.
+var errNoLocalConfig = errors.New("no local config found")
+
+// configFile is a file a config may be read from. decode reports whether
+// the file holds a lipstick config at all, package.json and pyproject.toml
+// are often there for other tools only.
+type configFile struct {
+	name   string
+	decode func(data []byte, cfg *Config) (bool, error)
+}
+
+// localConfigFiles are the files looked for in a repository, highest
+// precedence first. A mapping in a file earlier in the list overrides the
+// same key in a later one.
+var localConfigFiles = []configFile{
+	{".lipstickrc", decodeTOML},
+	{".lipstickrc.yaml", decodeYAML},
+	{".lipstickrc.yml", decodeYAML},
+	{".lipstickrc.json", decodeJSON},
+	{"package.json", decodePackageJSON},
+	{"pyproject.toml", decodePyproject},
+}
+
+func decodeTOML(data []byte, cfg *Config) (bool, error) {
+	_, err := toml.Decode(string(data), cfg)
+	return true, err
+}
+
+func decodeYAML(data []byte, cfg *Config) (bool, error) {
+	return true, yaml.Unmarshal(data, cfg)
+}
+
+func decodeJSON(data []byte, cfg *Config) (bool, error) {
+	return true, json.Unmarshal(data, cfg)
+}
+
+// decodePackageJSON reads the "lipstick" key of a package.json.
+func decodePackageJSON(data []byte, cfg *Config) (bool, error) {
+	var pkg struct {
+		Lipstick json.RawMessage `json:"lipstick"`
+	}
+	if err := json.Unmarshal(data, &pkg); err != nil {
+		return false, err
+	}
+	if pkg.Lipstick == nil {
+		return false, nil
+	}
+	return decodeJSON(pkg.Lipstick, cfg)
+}
+
+// decodePyproject reads the [tool.lipstick] table of a pyproject.toml.
+func decodePyproject(data []byte, cfg *Config) (bool, error) {
+	var py struct {
+		Tool struct {
+			Lipstick *Config `toml:"lipstick"`
+		} `toml:"tool"`
+	}
+	if _, err := toml.Decode(string(data), &py); err != nil {
+		return false, err
+	}
+	if py.Tool.Lipstick == nil {
+		return false, nil
+	}
+	*cfg = *py.Tool.Lipstick
+	return true, nil
+}
+
+// merge adds the mappings, tables, output settings and policy of other to
+// cfg, overriding what cfg already has.
+func (cfg *Config) merge(other *Config) {
+	if cfg.Words == nil {
+		cfg.Words = map[string]string{}
+		cfg.Sources = map[string]string{}
+	}
+	for key, value := range other.Words {
+		cfg.Words[key] = value
+		cfg.Sources[key] = other.Sources[key]
+	}
+	for name, t := range other.Tables {
+		if cfg.Tables == nil {
+			cfg.Tables = map[string]Table{}
+		}
+		merged := cfg.Tables[name]
+		if t.Delimiter != "" {
+			merged.Delimiter = t.Delimiter
+		}
+		if merged.Words == nil {
+			merged.Words = map[string]string{}
+		}
+		for key, value := range t.Words {
+			merged.Words[key] = value
+			cfg.Sources[tableSourceKey(name, key)] = other.Sources[tableSourceKey(name, key)]
+		}
+		cfg.Tables[name] = merged
+	}
+	for glob, kinds := range other.Paths {
+		if cfg.Paths == nil {
+			cfg.Paths = map[string][]string{}
+		}
+		cfg.Paths[glob] = kinds
+	}
+	for kind, rules := range other.Kinds {
+		if cfg.Kinds == nil {
+			cfg.Kinds = map[string]KindRules{}
+		}
+		cfg.Kinds[kind] = rules
+	}
+	if other.Output.Mode != "" {
+		cfg.Output.Mode = other.Output.Mode
+	}
+	if other.Output.Trailer != "" {
+		cfg.Output.Trailer = other.Output.Trailer
+	}
+	if other.Output.NotesRef != "" {
+		cfg.Output.NotesRef = other.Output.NotesRef
+	}
+	if other.Policy.Match != "" {
+		cfg.Policy.Match = other.Policy.Match
+	}
+	if other.Policy.Autocorrect != "" {
+		cfg.Policy.Autocorrect = other.Policy.Autocorrect
+	}
+	cfg.Files = append(cfg.Files, other.Files...)
+}
+
+// showConfig prints the effective config and the files it came from, as a
+// TOML file that could replace them.
+func showConfig(dir string, w io.Writer) error {
+	cfg, err := loadEmojiMap(dir)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(w, "# loaded from, later files override earlier ones:")
+	for _, f := range cfg.Files {
+		fmt.Fprintln(w, "#  ", f)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "[output]")
+	fmt.Fprintf(w, "mode = %s\n", quoteString(cfg.Output.mode()))
+	fmt.Fprintf(w, "trailer = %s\n", quoteString(cfg.Output.trailer()))
+	fmt.Fprintf(w, "notesRef = %s\n", quoteString(cfg.Output.notesRef()))
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "[policy]")
+	fmt.Fprintf(w, "match = %s\n", quoteString(cfg.Policy.match()))
+	fmt.Fprintf(w, "autocorrect = %s\n", quoteString(cfg.Policy.autocorrect()))
+	fmt.Fprintln(w)
+	if len(cfg.Paths) > 0 {
+		globs := make([]string, 0, len(cfg.Paths))
+		for glob := range cfg.Paths {
+			globs = append(globs, glob)
+		}
+		sort.Strings(globs)
+		fmt.Fprintln(w, "[paths]")
+		for _, glob := range globs {
+			fmt.Fprintf(w, "%s = %s\n", quoteString(glob), quoteList(cfg.Paths[glob]))
+		}
+		fmt.Fprintln(w)
+	}
+	kinds := make([]string, 0, len(cfg.Kinds))
+	for kind := range cfg.Kinds {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		rules := cfg.Kinds[kind]
+		fmt.Fprintf(w, "[kinds.%s]\n", quoteString(kind))
+		if rules.Template != "" {
+			fmt.Fprintf(w, "template = %s\n", quoteString(rules.Template))
+		}
+		fmt.Fprintf(w, "sections = %s\n", quoteList(rules.Sections))
+		fmt.Fprintf(w, "trailers = %s\n", quoteList(rules.Trailers))
+		fmt.Fprintln(w)
+	}
+	for _, name := range cfg.tableNames() {
+		// writeTOML has the delimiters of tables with words.
+		if len(cfg.Tables[name].Words) > 0 {
+			continue
+		}
+		fmt.Fprintf(w, "[tables.%s]\n", quoteString(name))
+		fmt.Fprintf(w, "delimiter = %s\n", quoteString(cfg.Tables[name].Delimiter))
+		fmt.Fprintln(w)
+	}
+	mappings, _ := selectMappings(cfg, listOptions{source: len(cfg.Files) > 1})
+	return writeTOML(w, mappings, len(cfg.Files) > 1)
+}
+
+// quoteList formats ss as a TOML array of strings.
+func quoteList(ss []string) string {
+	quoted := make([]string, len(ss))
+	for i, s := range ss {
+		quoted[i] = quoteString(s)
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
+
+// localConfigPaths returns every file a local config in dir may be read
+// from.
+func localConfigPaths(dir string) []string {
+	var paths []string
+	for _, f := range localConfigFiles {
+		paths = append(paths, filepath.Join(dir, f.name))
+	}
+	return paths
+}
+
+// readLocalConfig merges every local config file found in dir, lowest
+// precedence first, each with the configs it extends. Files that exist but
+// do not decode are an error.
+func readLocalConfig(dir string) (*Config, error) {
+	cfg := &Config{}
+	for i := len(localConfigFiles) - 1; i >= 0; i-- {
+		f := localConfigFiles[i]
+		path := filepath.Join(dir, f.name)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			continue
+		}
+		file, found, err := readConfigFile(configLocation{dir: dir, path: path}, f.decode, nil)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			cfg.merge(file)
+		}
+	}
+	if cfg.Files == nil {
+		return nil, errNoLocalConfig
+	}
+	return cfg, nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jesusrmoreno/lipstick/internal/git"
+)
+
+// managedMarker identifies hook scripts written by install --global.
+const managedMarker = "# managed by lipstick install --global"
+
+// previousHooksFile remembers the core.hooksPath that was set before
+// lipstick took it over so it can be chained to and restored.
+const previousHooksFile = "previous-hooks-path"
+
+// clientHooks are the hooks git runs on the client side. Setting
+// core.hooksPath hides a repository's own .git/hooks, so every one of them
+// gets a stub that hands over to the repository's hook.
+var clientHooks = []string{
+	"applypatch-msg", "pre-applypatch", "post-applypatch", "pre-commit",
+	"pre-merge-commit", "prepare-commit-msg", "commit-msg", "post-commit",
+	"pre-rebase", "post-checkout", "post-merge", "pre-push", "post-rewrite",
+	"pre-auto-gc", "push-to-checkout",
+}
+
+// stdinHooks are the client hooks git feeds input on stdin. A stub running
+// more than one hook for them keeps the input so each hook gets all of it.
+var stdinHooks = map[string]bool{"pre-push": true, "post-rewrite": true}
+
+// globalDir returns the directory lipstick manages under the user's config
+// directory.
+func globalDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "lipstick"), nil
+}
+
+// chainScript builds a hook that runs the repository's own hook and then the
+// hook from any hooks path that was configured before lipstick, stopping at
+// the first failure. The commit-msg and prepare-commit-msg hooks then run
+// lipstick itself. The input of the hooks in stdinHooks is saved first and
+// given to both.
+func chainScript(name, previous string) string {
+	var b strings.Builder
+	b.WriteString("#!/bin/sh\n" + managedMarker + "\n")
+	input := ""
+	if previous != "" && stdinHooks[name] {
+		b.WriteString("input=\"$(mktemp)\" || exit 1\n")
+		b.WriteString("trap 'rm -f \"$input\"' EXIT\n")
+		b.WriteString("cat > \"$input\"\n")
+		input = " < \"$input\""
+	}
+	b.WriteString("repo_hook=\"$(git rev-parse --git-common-dir)/hooks/" + name + "\"\n")
+	b.WriteString("if [ -x \"$repo_hook\" ]; then \"$repo_hook\" \"$@\"" + input + " || exit $?; fi\n")
+	if previous != "" {
+		b.WriteString("prev_hook=" + shellQuote(filepath.Join(previous, name)) + "\n")
+		b.WriteString("if [ -x \"$prev_hook\" ]; then \"$prev_hook\" \"$@\"" + input + " || exit $?; fi\n")
+	}
+	switch name {
+	case "commit-msg":
+		b.WriteString(hook)
+	case "prepare-commit-msg":
+		b.WriteString(prepareHook)
+	}
+	return b.String()
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+func writeHook(path, script string) error {
+	if err := writeFile(path, script); err != nil {
+		return err
+	}
+	return chmod(path, 0755)
+}
+
+// setGitConfig and unsetGitConfig edit a git config file like git.SetConfig
+// and git.UnsetConfig, through writeFile.
+func setGitConfig(path, key, value string) error {
+	data, err := readFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return writeFile(path, git.SetConfigText(string(data), key, value))
+}
+
+func unsetGitConfig(path, key string) error {
+	data, err := readFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return writeFile(path, git.UnsetConfigText(string(data), key))
+}
+
+// installGlobal writes the managed hooks and points git at them. With
+// template set, init.templateDir is used instead so only repositories
+// created or cloned afterwards pick the hook up.
+func installGlobal(template bool) error {
+	dir, err := globalDir()
+	if err != nil {
+		return err
+	}
+	cfgPath := git.GlobalConfigPath()
+	gitCfg, err := git.ReadConfig(cfgPath)
+	if err != nil {
+		return ioError(fmt.Errorf("could not read %s: %v", cfgPath, err))
+	}
+
+	if template {
+		hooks := filepath.Join(dir, "template", "hooks")
+		script := "#!/bin/sh\n" + hook
+		if err := writeHook(filepath.Join(hooks, "commit-msg"), script); err != nil {
+			return ioError(fmt.Errorf("unable to create the commit-msg hook: %v", err))
+		}
+		if cur := gitCfg.Get("init.templateDir"); cur != "" && cur != filepath.Dir(hooks) {
+			return fmt.Errorf("init.templateDir is already set to %s", cur)
+		}
+		if err := setGitConfig(cfgPath, "init.templateDir", filepath.Dir(hooks)); err != nil {
+			return ioError(fmt.Errorf("could not update %s: %v", cfgPath, err))
+		}
+		log.Println("new repositories will use the hook from", hooks)
+		return nil
+	}
+
+	hooks := filepath.Join(dir, "hooks")
+	previous := gitCfg.Get("core.hooksPath")
+	if previous == hooks {
+		data, _ := readFile(filepath.Join(dir, previousHooksFile))
+		previous = strings.TrimSpace(string(data))
+	} else if previous != "" {
+		if err := writeFile(filepath.Join(dir, previousHooksFile), previous+"\n"); err != nil {
+			return err
+		}
+	}
+	// The previous path is kept as configured so uninstall restores it
+	// exactly, the hooks need it expanded.
+	previousDir, err := expandHome(previous)
+	if err != nil {
+		return err
+	}
+	for _, name := range clientHooks {
+		if err := writeHook(filepath.Join(hooks, name), chainScript(name, previousDir)); err != nil {
+			return ioError(fmt.Errorf("unable to create the %s hook: %v", name, err))
+		}
+	}
+	if err := setGitConfig(cfgPath, "core.hooksPath", hooks); err != nil {
+		return ioError(fmt.Errorf("could not update %s: %v", cfgPath, err))
+	}
+	log.Println("created global hooks in", hooks)
+	return nil
+}
+
+// uninstallGlobal reverses installGlobal, restoring a core.hooksPath that
+// was set before.
+func uninstallGlobal() error {
+	dir, err := globalDir()
+	if err != nil {
+		return err
+	}
+	cfgPath := git.GlobalConfigPath()
+	gitCfg, err := git.ReadConfig(cfgPath)
+	if err != nil {
+		return ioError(fmt.Errorf("could not read %s: %v", cfgPath, err))
+	}
+
+	if gitCfg.Get("core.hooksPath") == filepath.Join(dir, "hooks") {
+		data, _ := readFile(filepath.Join(dir, previousHooksFile))
+		if previous := strings.TrimSpace(string(data)); previous != "" {
+			err = setGitConfig(cfgPath, "core.hooksPath", previous)
+		} else {
+			err = unsetGitConfig(cfgPath, "core.hooksPath")
+		}
+		if err != nil {
+			return ioError(fmt.Errorf("could not update %s: %v", cfgPath, err))
+		}
+	}
+	if gitCfg.Get("init.templateDir") == filepath.Join(dir, "template") {
+		if err := unsetGitConfig(cfgPath, "init.templateDir"); err != nil {
+			return ioError(fmt.Errorf("could not update %s: %v", cfgPath, err))
+		}
+	}
+	for _, sub := range []string{"hooks", "template", previousHooksFile} {
+		if err := removeAll(filepath.Join(dir, sub)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// globalStatus describes the global install for the status command.
+func globalStatus() string {
+	dir, err := globalDir()
+	if err != nil {
+		return ""
+	}
+	gitCfg, err := git.ReadConfig(git.GlobalConfigPath())
+	if err != nil {
+		return ""
+	}
+	switch {
+	case gitCfg.Get("core.hooksPath") == filepath.Join(dir, "hooks"):
+		return fmt.Sprintf("global: installed (core.hooksPath = %s)", filepath.Join(dir, "hooks"))
+	case gitCfg.Get("init.templateDir") == filepath.Join(dir, "template"):
+		return fmt.Sprintf("global: installed (init.templateDir = %s)", filepath.Join(dir, "template"))
+	}
+	return ""
+}
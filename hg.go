@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Mercurial has no hook that may edit the message before it is stored
+// (pretxncommit can only veto a commit) so lipstick runs from the commit hook
+// and amends the description of the new changeset when it changes. Every
+// file is left out of the amend, so changes still in the working directory
+// stay there. The amend fires the hook again, which then finds nothing left
+// to replace.
+const (
+	hgHookComment = "# added by lipstick"
+	hgHookLine    = "commit.lipstick = lipstick hg-hook"
+)
+
+// hgVCS installs lipstick as a hook in .hg/hgrc.
+type hgVCS struct {
+	root string
+}
+
+func (h hgVCS) name() string { return "mercurial" }
+
+func (h hgVCS) hgrc() string { return filepath.Join(h.root, ".hg", "hgrc") }
+
+func (h hgVCS) install(cfg *Config) error {
+	d, err := readFile(h.hgrc())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	rc := string(d)
+	if strings.Contains(rc, hgHookLine) {
+		return nil
+	}
+	entry := hgHookComment + "\n" + hgHookLine + "\n"
+	lines := strings.SplitAfter(rc, "\n")
+	out := ""
+	added := false
+	for _, l := range lines {
+		out += l
+		if !added && strings.TrimSpace(l) == "[hooks]" {
+			if !strings.HasSuffix(l, "\n") {
+				out += "\n"
+			}
+			out += entry
+			added = true
+		}
+	}
+	if !added {
+		if out != "" && !strings.HasSuffix(out, "\n") {
+			out += "\n"
+		}
+		out += "\n[hooks]\n" + entry
+	}
+	return writeFile(h.hgrc(), out)
+}
+
+func (h hgVCS) uninstall() error {
+	entry := hgHookComment + "\n" + hgHookLine + "\n"
+	d, err := readFile(h.hgrc())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	// Drop the [hooks] section too when install added it and nothing has
+	// been put in it since.
+	if rc := string(d); strings.HasSuffix(rc, "\n[hooks]\n"+entry) {
+		rc = strings.TrimSuffix(rc, "\n[hooks]\n"+entry)
+		return writeFile(h.hgrc(), rc)
+	}
+	return removeHook(h.hgrc(), entry)
+}
+
+func (h hgVCS) status() (bool, string, error) {
+	d, err := readFile(h.hgrc())
+	if os.IsNotExist(err) {
+		return false, h.hgrc(), nil
+	} else if err != nil {
+		return false, h.hgrc(), err
+	}
+	return strings.Contains(string(d), hgHookLine), h.hgrc(), nil
+}
+
+// hgCommand runs hg in dir with a plain, script friendly environment.
+func hgCommand(dir string, args ...string) *exec.Cmd {
+	cmd := exec.Command("hg", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "HGPLAIN=1")
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+// hgHook is run by Mercurial's commit hook. It applies the mappings to the
+// message of the changeset in $HG_NODE and amends its description if
+// anything changed.
+func hgHook(dir string) error {
+	node := os.Getenv("HG_NODE")
+	if node == "" {
+		return fmt.Errorf("HG_NODE is not set, hg-hook must be run by Mercurial")
+	}
+	cfg, err := loadEmojiMap(dir)
+	if err != nil {
+		return err
+	}
+	desc, err := hgCommand(dir, "log", "-r", node, "--template", "{desc}").Output()
+	if err != nil {
+		return err
+	}
+	msg, _ := annotate(cfg, string(desc))
+	if msg == string(desc) {
+		return nil
+	}
+	// path:. excludes every file, so only the description is amended.
+	return hgCommand(dir, "commit", "--amend", "-X", "path:.", "-m", msg).Run()
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jesusrmoreno/lipstick/internal/git"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// testBinaryEnv makes the test binary run lipstick's main instead of the
+// tests, so the hooks of the repositories below can run it as lipstick.
+const testBinaryEnv = "LIPSTICK_TEST_BINARY"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(testBinaryEnv) == "1" {
+		main()
+		os.Exit(exitOK)
+	}
+	os.Exit(m.Run())
+}
+
+// testRepo is a git repository in a temporary directory. git, the hooks
+// and the commands called from the test all see a home directory of their
+// own, so nothing of the user's config leaks in or is changed.
+type testRepo struct {
+	t   *testing.T
+	dir string
+	env []string
+}
+
+// newTestRepo creates an empty repository with lipstick on the PATH of its
+// hooks. The test is skipped when git is not installed.
+func newTestRepo(t *testing.T) *testRepo {
+	gitPath, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git is not installed")
+	}
+	root := t.TempDir()
+	home := filepath.Join(root, "home")
+	bin := filepath.Join(root, "bin")
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(home, 0755)
+	os.MkdirAll(bin, 0755)
+	if err := os.Symlink(self, filepath.Join(bin, "lipstick")); err != nil {
+		t.Fatal(err)
+	}
+	// The commands run in this process look at the home directory too.
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(home, ".config"))
+	t.Setenv("GIT_CONFIG_GLOBAL", filepath.Join(home, ".gitconfig"))
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+
+	r := &testRepo{t: t, dir: filepath.Join(root, "repo")}
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "LIPSTICK_") && !strings.HasPrefix(kv, "PATH=") {
+			r.env = append(r.env, kv)
+		}
+	}
+	r.env = append(r.env,
+		"PATH="+bin+string(os.PathListSeparator)+filepath.Dir(gitPath),
+		testBinaryEnv+"=1",
+		"GIT_AUTHOR_NAME=Test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=Test", "GIT_COMMITTER_EMAIL=test@example.com",
+	)
+	r.git("init", "-q", r.dir)
+	return r
+}
+
+// git runs git in the repository and returns its output, failing the test
+// when it fails.
+func (r *testRepo) git(args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = filepath.Dir(r.dir)
+	if isDir(r.dir) {
+		cmd.Dir = r.dir
+	}
+	cmd.Env = r.env
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		r.t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return string(out)
+}
+
+func (r *testRepo) path(name string) string {
+	return filepath.Join(r.dir, name)
+}
+
+func (r *testRepo) write(name, data string, mode os.FileMode) {
+	os.MkdirAll(filepath.Dir(r.path(name)), 0755)
+	if err := ioutil.WriteFile(r.path(name), []byte(data), mode); err != nil {
+		r.t.Fatal(err)
+	}
+}
+
+func (r *testRepo) read(name string) string {
+	data, _ := ioutil.ReadFile(r.path(name))
+	return string(data)
+}
+
+// commit commits a change to a file with msg through the hooks and
+// returns the message git recorded.
+func (r *testRepo) commit(msg string) string {
+	f, _ := os.OpenFile(r.path("file"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString(msg + "\n")
+	f.Close()
+	r.git("add", "file")
+	r.git("commit", "-q", "-m", msg)
+	return r.git("log", "-1", "--format=%B")
+}
+
+// worktree adds a linked worktree on a new branch and returns a handle on
+// it sharing the repository's environment.
+func (r *testRepo) worktree(branch string) *testRepo {
+	wt := &testRepo{t: r.t, dir: filepath.Join(filepath.Dir(r.dir), branch), env: r.env}
+	r.git("worktree", "add", "-q", "-b", branch, wt.dir)
+	return wt
+}
+
+func TestInstallCommitUninstall(t *testing.T) {
+	Convey("Given a new repository", t, func() {
+		r := newTestRepo(t)
+		So(install(r.dir), ShouldBeNil)
+		So(r.read(".git/hooks/commit-msg.d/"+lipstickEntry), ShouldContainSubstring, "lipstick commit-msg \"$1\"")
+		var out bytes.Buffer
+		So(status(r.dir, &out), ShouldBeNil)
+		So(out.String(), ShouldStartWith, "git: installed")
+
+		Convey("Commits should have their tokens replaced", func() {
+			So(r.commit(":bugfix: fix it"), ShouldEqual, ":bug: fix it\n\n")
+		})
+
+		Convey("Uninstalling should remove the hook", func() {
+			So(uninstall(r.dir), ShouldBeNil)
+			_, err := os.Stat(r.path(".git/hooks/commit-msg"))
+			So(os.IsNotExist(err), ShouldBeTrue)
+			So(r.commit(":bugfix: fix it"), ShouldEqual, ":bugfix: fix it\n\n")
+		})
+	})
+
+	Convey("Given a repository with a commit-msg hook of its own", t, func() {
+		r := newTestRepo(t)
+		original := "#!/bin/sh\nprintf '\\nChecked-by: hook\\n' >> \"$1\"\n"
+		r.write(".git/hooks/commit-msg", original, 0755)
+		So(install(r.dir), ShouldBeNil)
+
+		Convey("Both hooks should run on commit", func() {
+			So(r.commit(":bugfix: fix it"), ShouldEqual, ":bug: fix it\n\nChecked-by: hook\n\n")
+		})
+
+		Convey("Uninstalling should bring the hook back as it was", func() {
+			So(uninstall(r.dir), ShouldBeNil)
+			So(r.read(".git/hooks/commit-msg"), ShouldEqual, original)
+			So(r.commit(":bugfix: fix it"), ShouldEqual, ":bugfix: fix it\n\nChecked-by: hook\n\n")
+		})
+	})
+
+	Convey("Given a repository with core.hooksPath set", t, func() {
+		r := newTestRepo(t)
+		r.git("config", "core.hooksPath", ".githooks")
+		So(install(r.dir), ShouldBeNil)
+		So(r.read(".githooks/commit-msg.d/"+lipstickEntry), ShouldContainSubstring, "lipstick commit-msg")
+		So(r.read(".git/hooks/commit-msg"), ShouldBeEmpty)
+		So(r.commit(":bugfix: fix it"), ShouldEqual, ":bug: fix it\n\n")
+	})
+
+	Convey("Given a linked worktree", t, func() {
+		r := newTestRepo(t)
+		r.commit("initial")
+		wt := r.worktree("feature")
+
+		Convey("Installing from it should hook every worktree", func() {
+			So(install(wt.dir), ShouldBeNil)
+			So(r.read(".git/hooks/commit-msg.d/"+lipstickEntry), ShouldContainSubstring, "lipstick commit-msg")
+			So(wt.commit(":bugfix: in the worktree"), ShouldEqual, ":bug: in the worktree\n\n")
+			So(r.commit(":bugfix: in the main one"), ShouldEqual, ":bug: in the main one\n\n")
+		})
+	})
+
+	Convey("Given a repository keeping kinds in notes", t, func() {
+		r := newTestRepo(t)
+		r.write(".lipstickrc", "[commitKinds]\nbugfix = \":bug:\"\n\n[output]\nmode = \"notes\"\n", 0644)
+		So(install(r.dir), ShouldBeNil)
+		So(r.read(".git/hooks/post-commit.d/"+lipstickEntry), ShouldContainSubstring, "lipstick note")
+
+		Convey("The kinds should move from the message to a note", func() {
+			So(r.commit(":bugfix: fix it"), ShouldEqual, "fix it\n\n")
+			So(r.git("notes", "--ref", defaultNotesRef, "show", "HEAD"), ShouldEqual, "Kind: bugfix\n")
+			_, err := os.Stat(r.path(".git/" + pendingKindsFile))
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+	})
+}
+
+func TestHgHook(t *testing.T) {
+	if _, err := exec.LookPath("hg"); err != nil {
+		t.Skip("hg is not installed")
+	}
+	Convey("Given a changeset committed with changes left in the working directory", t, func() {
+		dir := t.TempDir()
+		t.Setenv("HGRCPATH", "")
+		t.Setenv("HGUSER", "Test <test@example.com>")
+		hg := func(args ...string) string {
+			out, err := hgCommand(dir, args...).Output()
+			So(err, ShouldBeNil)
+			return string(out)
+		}
+		hg("init")
+		ioutil.WriteFile(filepath.Join(dir, "committed"), []byte("one\n"), 0644)
+		ioutil.WriteFile(filepath.Join(dir, "dirty"), []byte("one\n"), 0644)
+		hg("add", "committed", "dirty")
+		hg("commit", "-m", "initial")
+		ioutil.WriteFile(filepath.Join(dir, "committed"), []byte("two\n"), 0644)
+		ioutil.WriteFile(filepath.Join(dir, "dirty"), []byte("two\n"), 0644)
+		hg("commit", "-m", ":bugfix: fix it", "committed")
+		t.Setenv("HG_NODE", strings.TrimSpace(hg("log", "-r", ".", "--template", "{node}")))
+
+		Convey("The hook should only amend the description", func() {
+			So(hgHook(dir), ShouldBeNil)
+			So(hg("log", "-r", ".", "--template", "{desc}"), ShouldEqual, ":bug: fix it")
+			So(hg("log", "-r", ".", "--template", "{files}"), ShouldEqual, "committed")
+			So(hg("cat", "-r", ".", "dirty"), ShouldEqual, "one\n")
+			So(hg("status"), ShouldEqual, "M dirty\n")
+		})
+	})
+}
+
+// objectFiles returns the names of the loose objects of the repository.
+func (r *testRepo) objectFiles() []string {
+	var names []string
+	filepath.Walk(r.path(".git/objects"), func(p string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() {
+			names = append(names, p)
+		}
+		return nil
+	})
+	return names
+}
+
+func TestRewriteHistory(t *testing.T) {
+	Convey("Given a branch with tokens in its messages and a signed commit", t, func() {
+		r := newTestRepo(t)
+		r.write(".lipstickrc", "[commitKinds]\nbugfix = \":bug:\"\ndocs = \":books:\"\n", 0644)
+		rev := func(s string) string { return strings.TrimSpace(r.git("rev-parse", s)) }
+		branch := strings.TrimSpace(r.git("symbolic-ref", "HEAD"))
+
+		r.commit(":bugfix: before the range")
+		outside := rev("HEAD")
+		r.write("file", "fixed\n", 0644)
+		r.git("add", "file")
+		r.git("commit", "-q", "-m", ":bugfix: fix it", "--author", "Ann <ann@example.com>", "--date", "2001-02-03T04:05:06+02:00")
+		fixed := rev("HEAD")
+		r.write("file", "documented\n", 0644)
+		r.git("add", "file")
+		signed := "tree " + strings.TrimSpace(r.git("write-tree")) + "\nparent " + fixed + "\n" +
+			"author Bob <bob@example.com> 1000000000 +0000\ncommitter Bob <bob@example.com> 1000000000 +0000\n" +
+			"gpgsig -----BEGIN PGP SIGNATURE-----\n \n iQEzBAABCAAdFiEE\n -----END PGP SIGNATURE-----\n\n:docs: write it\n"
+		ioutil.WriteFile(filepath.Join(filepath.Dir(r.dir), "signed"), []byte(signed), 0644)
+		documented := strings.TrimSpace(r.git("hash-object", "-t", "commit", "-w", filepath.Join(filepath.Dir(r.dir), "signed")))
+		r.git("update-ref", "HEAD", documented)
+		r.commit("plain")
+		tip := rev("HEAD")
+
+		var logs bytes.Buffer
+		log.SetOutput(&logs)
+		defer log.SetOutput(os.Stderr)
+
+		Convey("A dry run should write no objects or refs", func() {
+			objects := r.objectFiles()
+			refs := r.git("for-each-ref")
+			So(rewriteHistory(r.dir, "HEAD~3..HEAD", true, false), ShouldBeNil)
+			So(r.objectFiles(), ShouldResemble, objects)
+			So(r.git("for-each-ref"), ShouldEqual, refs)
+			So(logs.String(), ShouldContainSubstring, "2 of 3 commits on "+branch+" would be rewritten")
+		})
+
+		Convey("Rewriting the range should only change the messages in it", func() {
+			So(rewriteHistory(r.dir, "HEAD~3..HEAD", false, false), ShouldBeNil)
+			So(r.git("log", "--format=%s"), ShouldEqual, "plain\n:books: write it\n:bug: fix it\n:bugfix: before the range\n")
+			So(rev("HEAD~3"), ShouldEqual, outside)
+			format := "--format=%T %an <%ae> %ad %cn <%ce> %cd"
+			for n, old := range map[string]string{"HEAD": tip, "HEAD~1": documented, "HEAD~2": fixed} {
+				So(rev(n), ShouldNotEqual, old)
+				So(r.git("log", "-1", format, n), ShouldEqual, r.git("log", "-1", format, old))
+			}
+			history := r.git("rev-list", "HEAD")
+			So(history, ShouldNotContainSubstring, fixed)
+			So(history, ShouldNotContainSubstring, documented)
+			So(history, ShouldContainSubstring, outside)
+
+			Convey("The signature should be dropped with a warning", func() {
+				So(r.git("cat-file", "commit", "HEAD~1"), ShouldNotContainSubstring, "gpgsig")
+				So(logs.String(), ShouldContainSubstring, "warning: commit "+documented[:7]+" is signed")
+			})
+
+			Convey("The old tip should be kept under refs/original/", func() {
+				So(rev(backupPrefix+branch), ShouldEqual, tip)
+			})
+
+			Convey("Rewriting again should need --force", func() {
+				r.commit(":docs: more")
+				head := rev("HEAD")
+				err := rewriteHistory(r.dir, "HEAD~1..HEAD", false, false)
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "use --force")
+				So(rev("HEAD"), ShouldEqual, head)
+				So(rev(backupPrefix+branch), ShouldEqual, tip)
+
+				So(rewriteHistory(r.dir, "HEAD~1..HEAD", false, true), ShouldBeNil)
+				So(r.git("log", "-1", "--format=%s"), ShouldEqual, ":books: more\n")
+				So(rev(backupPrefix+branch), ShouldEqual, head)
+			})
+		})
+	})
+}
+
+func TestInstallGlobal(t *testing.T) {
+	Convey("Given a global core.hooksPath with hooks of its own", t, func() {
+		r := newTestRepo(t)
+		previous := filepath.Join(filepath.Dir(r.dir), "previous-hooks")
+		r.git("config", "--global", "core.hooksPath", previous)
+		r.write("../previous-hooks/commit-msg", "#!/bin/sh\nprintf '\\nChecked-by: previous\\n' >> \"$1\"\n", 0755)
+		r.write("../previous-hooks/pre-push", "#!/bin/sh\ncat > \"$(git rev-parse --git-dir)/previous-input\"\n", 0755)
+		r.write(".git/hooks/pre-push", "#!/bin/sh\ncat > \"$(git rev-parse --git-dir)/repo-input\"\n", 0755)
+		So(installGlobal(false), ShouldBeNil)
+		dir, _ := globalDir()
+		So(r.git("config", "--global", "core.hooksPath"), ShouldEqual, filepath.Join(dir, "hooks")+"\n")
+
+		Convey("Commits should run the previous hook and lipstick", func() {
+			So(r.commit(":bugfix: fix it"), ShouldEqual, ":bug: fix it\n\nChecked-by: previous\n\n")
+		})
+
+		Convey("Both pre-push hooks should get all of the input", func() {
+			r.commit("initial")
+			r.git("init", "-q", "--bare", filepath.Join(filepath.Dir(r.dir), "remote"))
+			r.git("push", "-q", filepath.Join(filepath.Dir(r.dir), "remote"), "HEAD:refs/heads/pushed")
+			So(r.read(".git/repo-input"), ShouldContainSubstring, "refs/heads/pushed")
+			So(r.read(".git/previous-input"), ShouldEqual, r.read(".git/repo-input"))
+		})
+
+		Convey("Uninstalling should restore the previous hooks path", func() {
+			So(uninstallGlobal(), ShouldBeNil)
+			So(r.git("config", "--global", "core.hooksPath"), ShouldEqual, previous+"\n")
+			_, err := os.Stat(filepath.Join(dir, "hooks"))
+			So(os.IsNotExist(err), ShouldBeTrue)
+			So(r.commit(":bugfix: fix it"), ShouldEqual, ":bugfix: fix it\n\nChecked-by: previous\n\n")
+		})
+	})
+
+	Convey("Given a global core.hooksPath relative to the home directory", t, func() {
+		r := newTestRepo(t)
+		r.git("config", "--global", "core.hooksPath", "~/previous-hooks")
+		r.write("../home/previous-hooks/commit-msg", "#!/bin/sh\nprintf '\\nChecked-by: previous\\n' >> \"$1\"\n", 0755)
+		So(installGlobal(false), ShouldBeNil)
+
+		Convey("Commits should run the previous hook and lipstick", func() {
+			So(r.commit(":bugfix: fix it"), ShouldEqual, ":bug: fix it\n\nChecked-by: previous\n\n")
+		})
+
+		Convey("Uninstalling should restore the path as it was written", func() {
+			So(uninstallGlobal(), ShouldBeNil)
+			So(r.git("config", "--global", "core.hooksPath"), ShouldEqual, "~/previous-hooks\n")
+		})
+	})
+
+	Convey("Given no global hooks path", t, func() {
+		r := newTestRepo(t)
+		So(installGlobal(false), ShouldBeNil)
+		So(r.commit(":bugfix: fix it"), ShouldEqual, ":bug: fix it\n\n")
+		So(uninstallGlobal(), ShouldBeNil)
+		So(r.read("../home/.gitconfig"), ShouldNotContainSubstring, "hooksPath")
+	})
+}
+
+func TestKindStats(t *testing.T) {
+	Convey("Given commits with kinds in trailers, notes and subjects", t, func() {
+		r := newTestRepo(t)
+		r.write(".lipstickrc", "[commitKinds]\nbugfix = \":bug:\"\ndocs = \":books:\"\nfeature = \":sparkles:\"\n\n[output]\nnotesRef = \"refs/notes/kinds\"\n", 0644)
+		r.commit("nothing to see")
+		r.commit(":bug: fix it")
+		r.commit("write it\n\nKind: docs")
+		r.commit("add it")
+		r.git("notes", "--ref", "refs/notes/kinds", "add", "-m", "Kind: feature", "HEAD")
+		r.git("notes", "--ref", defaultNotesRef, "add", "-m", "Kind: docs", "HEAD")
+		r.commit(":docs: more of it")
+		r.commit(":bug: fix it again\n\nKind: bugfix")
+
+		c, err := loadEmojiMap(r.dir)
+		So(err, ShouldBeNil)
+		repo, err := git.OpenDir(r.dir)
+		So(err, ShouldBeNil)
+
+		Convey("Kinds should be read back from every source", func() {
+			commits, err := repo.Log("HEAD")
+			So(err, ShouldBeNil)
+			var kinds [][]string
+			for _, commit := range commits {
+				kinds = append(kinds, readKinds(c, repo, commit))
+			}
+			So(kinds, ShouldResemble, [][]string{{"bugfix"}, {"docs"}, {"feature"}, {"docs"}, {"bugfix"}, nil})
+		})
+
+		Convey("Each commit should be counted once per kind", func() {
+			counts, total, err := kindStats(c, repo, "HEAD")
+			So(err, ShouldBeNil)
+			So(total, ShouldEqual, 6)
+			So(counts, ShouldResemble, map[string]int{"bugfix": 2, "docs": 2, "feature": 1, "": 1})
+			So(sortedByCount(counts), ShouldResemble, []string{"bugfix", "docs", "", "feature"})
+
+			counts, total, err = kindStats(c, repo, "HEAD~3..HEAD")
+			So(err, ShouldBeNil)
+			So(total, ShouldEqual, 3)
+			So(counts, ShouldResemble, map[string]int{"bugfix": 1, "docs": 1, "feature": 1})
+		})
+	})
+}
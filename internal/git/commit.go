@@ -0,0 +1,136 @@
+package git
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Signature is the author or committer line of a commit.
+type Signature struct {
+	Name  string
+	Email string
+	When  time.Time
+}
+
+// parseSignature parses "Name <email> 1234567890 +0200".
+func parseSignature(s string) (Signature, error) {
+	var sig Signature
+	lt := strings.LastIndex(s, " <")
+	gt := strings.LastIndex(s, "> ")
+	if lt < 0 || gt < lt {
+		return sig, fmt.Errorf("malformed signature %q", s)
+	}
+	sig.Name = s[:lt]
+	sig.Email = s[lt+2 : gt]
+	fields := strings.Fields(s[gt+2:])
+	if len(fields) != 2 {
+		return sig, fmt.Errorf("malformed signature %q", s)
+	}
+	sec, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return sig, fmt.Errorf("malformed signature %q", s)
+	}
+	tz, err := time.Parse("-0700", fields[1])
+	if err != nil {
+		return sig, fmt.Errorf("malformed signature %q", s)
+	}
+	_, offset := tz.Zone()
+	sig.When = time.Unix(sec, 0).In(time.FixedZone("", offset))
+	return sig, nil
+}
+
+// String formats the signature the way git stores it.
+func (s Signature) String() string {
+	return fmt.Sprintf("%s <%s> %d %s", s.Name, s.Email, s.When.Unix(), s.When.Format("-0700"))
+}
+
+// Header is an extra commit header such as gpgsig, mergetag or encoding.
+// Multi-line values are stored without the leading continuation space.
+type Header struct {
+	Key   string
+	Value string
+}
+
+// Commit is a parsed commit object.
+type Commit struct {
+	Hash      Hash
+	Tree      Hash
+	Parents   []Hash
+	Author    Signature
+	Committer Signature
+	Extra     []Header
+	Message   string
+}
+
+// Signed reports whether the commit carries a GPG or SSH signature.
+func (c *Commit) Signed() bool {
+	for _, h := range c.Extra {
+		if h.Key == "gpgsig" || h.Key == "gpgsig-sha256" {
+			return true
+		}
+	}
+	return false
+}
+
+// Commit reads and parses the commit h.
+func (r *Repository) Commit(h Hash) (*Commit, error) {
+	t, data, err := r.Object(h)
+	if err != nil {
+		return nil, err
+	}
+	if t != CommitObject {
+		return nil, fmt.Errorf("object %s is a %s, not a commit", h, t)
+	}
+	c, err := parseCommit(data)
+	if err != nil {
+		return nil, fmt.Errorf("commit %s: %v", h, err)
+	}
+	c.Hash = h
+	return c, nil
+}
+
+func parseCommit(data []byte) (*Commit, error) {
+	c := &Commit{}
+	end := bytes.Index(data, []byte("\n\n"))
+	if end < 0 {
+		end = len(data)
+		c.Message = ""
+	} else {
+		c.Message = string(data[end+2:])
+	}
+	lines := strings.Split(string(data[:end]), "\n")
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		sp := strings.IndexByte(line, ' ')
+		if sp < 0 {
+			return nil, fmt.Errorf("malformed header %q", line)
+		}
+		key, value := line[:sp], line[sp+1:]
+		for i+1 < len(lines) && strings.HasPrefix(lines[i+1], " ") {
+			i++
+			value += "\n" + lines[i][1:]
+		}
+		var err error
+		switch key {
+		case "tree":
+			c.Tree, err = ParseHash(value)
+		case "parent":
+			var p Hash
+			p, err = ParseHash(value)
+			c.Parents = append(c.Parents, p)
+		case "author":
+			c.Author, err = parseSignature(value)
+		case "committer":
+			c.Committer, err = parseSignature(value)
+		default:
+			c.Extra = append(c.Extra, Header{Key: key, Value: value})
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
@@ -0,0 +1,338 @@
+package git
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Config is a parsed git config file. Keys are stored as
+// "section.subsection.name" with the section and name lower cased, the
+// same form git config --get accepts.
+type Config map[string][]string
+
+// Get returns the last value set for key.
+func (c Config) Get(key string) string {
+	v := c[normalizeKey(key)]
+	if len(v) == 0 {
+		return ""
+	}
+	return v[len(v)-1]
+}
+
+func normalizeKey(key string) string {
+	first := strings.Index(key, ".")
+	last := strings.LastIndex(key, ".")
+	if first < 0 {
+		return strings.ToLower(key)
+	}
+	return strings.ToLower(key[:first]) + key[first:last] + strings.ToLower(key[last:])
+}
+
+// ReadConfig parses the git config file at path. A missing file yields an
+// empty config. Includes are not followed.
+func ReadConfig(path string) (Config, error) {
+	c := Config{}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	section := ""
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' {
+			end := strings.LastIndex(line, "]")
+			if end < 0 {
+				continue
+			}
+			section = parseSectionHeader(line[1:end])
+			line = strings.TrimSpace(line[end+1:])
+			if line == "" {
+				continue
+			}
+		}
+		name, value := line, "true"
+		if eq := strings.Index(line, "="); eq >= 0 {
+			name = strings.TrimSpace(line[:eq])
+			value = parseConfigValue(line[eq+1:])
+		}
+		key := section + "." + strings.ToLower(name)
+		c[key] = append(c[key], value)
+	}
+	return c, s.Err()
+}
+
+// parseSectionHeader turns `core` or `remote "origin"` into the dotted
+// prefix used for keys.
+func parseSectionHeader(h string) string {
+	h = strings.TrimSpace(h)
+	if sp := strings.IndexByte(h, ' '); sp >= 0 {
+		sub := strings.TrimSpace(h[sp+1:])
+		sub = strings.Trim(sub, `"`)
+		sub = strings.Replace(sub, `\"`, `"`, -1)
+		sub = strings.Replace(sub, `\\`, `\`, -1)
+		return strings.ToLower(h[:sp]) + "." + sub
+	}
+	return strings.ToLower(h)
+}
+
+// parseConfigValue handles quoting, escapes and trailing comments.
+func parseConfigValue(v string) string {
+	var b strings.Builder
+	quoted := false
+	v = strings.TrimSpace(v)
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == '\\' && i+1 < len(v):
+			i++
+			switch v[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			default:
+				b.WriteByte(v[i])
+			}
+		case (c == '#' || c == ';') && !quoted:
+			return strings.TrimSpace(b.String())
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return strings.TrimRight(b.String(), " \t")
+}
+
+// GlobalConfigPath returns the user's global git config file.
+func GlobalConfigPath() string {
+	if p := os.Getenv("GIT_CONFIG_GLOBAL"); p != "" {
+		return p
+	}
+	home, _ := os.UserHomeDir()
+	p := filepath.Join(home, ".gitconfig")
+	if _, err := os.Stat(p); err != nil {
+		xdg := os.Getenv("XDG_CONFIG_HOME")
+		if xdg == "" {
+			xdg = filepath.Join(home, ".config")
+		}
+		if x := filepath.Join(xdg, "git", "config"); fileExists(x) {
+			return x
+		}
+	}
+	return p
+}
+
+func fileExists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}
+
+// Config returns the repository config layered over the global config.
+func (r *Repository) Config() (Config, error) {
+	c, err := ReadConfig(GlobalConfigPath())
+	if err != nil {
+		return nil, err
+	}
+	local, err := ReadConfig(filepath.Join(r.CommonDir, "config"))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range local {
+		c[k] = append(c[k], v...)
+	}
+	return c, nil
+}
+
+// Committer returns the identity git would use for a new commit, honouring
+// the GIT_COMMITTER_* environment variables before user.name and
+// user.email.
+func (r *Repository) Committer() Signature {
+	sig := Signature{
+		Name:  os.Getenv("GIT_COMMITTER_NAME"),
+		Email: os.Getenv("GIT_COMMITTER_EMAIL"),
+		When:  time.Now(),
+	}
+	if sig.Name == "" || sig.Email == "" {
+		cfg, _ := r.Config()
+		if sig.Name == "" {
+			sig.Name = cfg.Get("user.name")
+		}
+		if sig.Email == "" {
+			sig.Email = cfg.Get("user.email")
+		}
+	}
+	if sig.Name == "" {
+		sig.Name = "lipstick"
+	}
+	if sig.Email == "" {
+		sig.Email = "lipstick@localhost"
+	}
+	return sig
+}
+
+// splitKey splits "section.sub.name" into its section header and the
+// lower cased variable name.
+func splitKey(key string) (section, sub, name string) {
+	first := strings.Index(key, ".")
+	last := strings.LastIndex(key, ".")
+	section = strings.ToLower(key[:first])
+	if first != last {
+		sub = key[first+1 : last]
+	}
+	return section, sub, strings.ToLower(key[last+1:])
+}
+
+// lineKey returns the dotted section prefix of a section header line, or
+// the lower cased variable name of an assignment, and which of the two the
+// line is.
+func lineKey(line string) (string, bool) {
+	t := strings.TrimSpace(line)
+	if strings.HasPrefix(t, "[") {
+		if end := strings.LastIndex(t, "]"); end > 0 {
+			return parseSectionHeader(t[1:end]), true
+		}
+	}
+	if t == "" || t[0] == '#' || t[0] == ';' {
+		return "", false
+	}
+	if eq := strings.Index(t, "="); eq >= 0 {
+		t = t[:eq]
+	}
+	return strings.ToLower(strings.TrimSpace(t)), false
+}
+
+func quoteConfigValue(v string) string {
+	if v != strings.TrimSpace(v) || strings.ContainsAny(v, "#;\"\\") {
+		v = strings.Replace(v, `\`, `\\`, -1)
+		v = strings.Replace(v, `"`, `\"`, -1)
+		return `"` + v + `"`
+	}
+	return v
+}
+
+// SetConfig sets key in the config file at path, replacing existing values
+// or adding it to the end of its section, like git config --replace-all.
+func SetConfig(path, key, value string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return writeFileAtomic(path, []byte(SetConfigText(string(data), key, value)))
+}
+
+// SetConfigText is SetConfig for the text of a config file.
+func SetConfigText(text, key, value string) string {
+	section, sub, name := splitKey(key)
+	want := section
+	if sub != "" {
+		want += "." + sub
+	}
+	entry := "\t" + key[strings.LastIndex(key, ".")+1:] + " = " + quoteConfigValue(value) + "\n"
+	var out []string
+	cur, inserted, sectionEnd := "", false, -1
+	for _, line := range strings.SplitAfter(text, "\n") {
+		if line == "" {
+			continue
+		}
+		k, header := lineKey(line)
+		if header {
+			cur = k
+		} else if cur == want && k == name {
+			if !inserted {
+				out = append(out, entry)
+				inserted = true
+			}
+			continue
+		}
+		if !strings.HasSuffix(line, "\n") {
+			line += "\n"
+		}
+		out = append(out, line)
+		if cur == want {
+			sectionEnd = len(out)
+		}
+	}
+	if !inserted {
+		if sectionEnd >= 0 {
+			out = append(out[:sectionEnd], append([]string{entry}, out[sectionEnd:]...)...)
+		} else {
+			header := "[" + section + "]\n"
+			if sub != "" {
+				header = "[" + section + " \"" + strings.Replace(sub, `"`, `\"`, -1) + "\"]\n"
+			}
+			out = append(out, header, entry)
+		}
+	}
+	return strings.Join(out, "")
+}
+
+// UnsetConfig removes every value of key from the config file at path.
+func UnsetConfig(path, key string) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, []byte(UnsetConfigText(string(data), key)))
+}
+
+// UnsetConfigText is UnsetConfig for the text of a config file.
+func UnsetConfigText(text, key string) string {
+	section, sub, name := splitKey(key)
+	want := section
+	if sub != "" {
+		want += "." + sub
+	}
+	var out []string
+	cur := ""
+	for _, line := range strings.SplitAfter(text, "\n") {
+		k, header := lineKey(line)
+		if header {
+			cur = k
+		} else if cur == want && k == name {
+			continue
+		}
+		out = append(out, line)
+	}
+	return strings.Join(out, "")
+}
+
+// writeFileAtomic replaces path through a temporary file in the same
+// directory so readers never see a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if fi, err := os.Stat(path); err == nil {
+		os.Chmod(tmp.Name(), fi.Mode())
+	} else {
+		os.Chmod(tmp.Name(), 0644)
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,241 @@
+package git
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// gitCmd runs the git binary in dir, used only to build fixtures.
+func gitCmd(t *testing.T, dir string, args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=Tester", "GIT_AUTHOR_EMAIL=tester@example.com",
+		"GIT_COMMITTER_NAME=Tester", "GIT_COMMITTER_EMAIL=tester@example.com",
+		"GIT_CONFIG_NOSYSTEM=1", "HOME="+dir,
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// fixture creates a repository with a short linear history and a branch.
+func fixture(t *testing.T) string {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git binary not available")
+	}
+	dir, err := ioutil.TempDir("", "lipstick-git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gitCmd(t, dir, "init", "-q", "-b", "main")
+	for i, msg := range []string{":initial: start", ":docs: readme", ":bugfix: fix it"} {
+		name := filepath.Join(dir, "file.txt")
+		if err := ioutil.WriteFile(name, []byte(strings.Repeat("line\n", i+1)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		gitCmd(t, dir, "add", "file.txt")
+		date := fmt.Sprintf("2016-04-0%dT12:00:00+0200", i+1)
+		os.Setenv("GIT_COMMITTER_DATE", date)
+		gitCmd(t, dir, "commit", "-q", "-m", msg, "--date", date)
+	}
+	os.Unsetenv("GIT_COMMITTER_DATE")
+	gitCmd(t, dir, "tag", "-a", "v1", "-m", "release", "HEAD~1")
+	gitCmd(t, dir, "checkout", "-q", "-b", "topic")
+	ioutil.WriteFile(filepath.Join(dir, "other.txt"), []byte("x"), 0644)
+	gitCmd(t, dir, "add", "other.txt")
+	gitCmd(t, dir, "commit", "-q", "-m", ":tests: topic work")
+	gitCmd(t, dir, "checkout", "-q", "main")
+	return dir
+}
+
+func mustResolve(t *testing.T, r *Repository, rev string) Hash {
+	h, err := r.Resolve(rev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func subjects(cs []*Commit) []string {
+	out := []string{}
+	for _, c := range cs {
+		out = append(out, strings.SplitN(c.Message, "\n", 2)[0])
+	}
+	return out
+}
+
+func TestRepository(t *testing.T) {
+	dir := fixture(t)
+	defer os.RemoveAll(dir)
+
+	check := func(r *Repository) {
+		head, err := r.Resolve("HEAD")
+		So(err, ShouldBeNil)
+		So(head.String(), ShouldEqual, gitCmd(t, dir, "rev-parse", "HEAD"))
+
+		c, err := r.Commit(head)
+		So(err, ShouldBeNil)
+		So(c.Message, ShouldEqual, ":bugfix: fix it\n")
+		So(c.Author.Name, ShouldEqual, "Tester")
+		So(c.Author.String(), ShouldEndWith, " +0200")
+		So(len(c.Parents), ShouldEqual, 1)
+
+		tag, err := r.Resolve("v1")
+		So(err, ShouldBeNil)
+		So(tag.String(), ShouldEqual, gitCmd(t, dir, "rev-parse", "HEAD~1"))
+
+		short, err := r.Resolve(head.String()[:8] + "~2")
+		So(err, ShouldBeNil)
+		So(short.String(), ShouldEqual, gitCmd(t, dir, "rev-parse", "HEAD~2"))
+
+		data, err := r.File(head, "file.txt")
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "line\nline\nline\n")
+		data, err = r.File(mustResolve(t, r, "topic"), "/other.txt")
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "x")
+		_, err = r.File(head, "other.txt")
+		So(err.Error(), ShouldEqual, "path other.txt: not found")
+		_, err = r.File(head, "file.txt/nested")
+		So(err, ShouldNotBeNil)
+
+		log, err := r.Log("main..topic")
+		So(err, ShouldBeNil)
+		So(subjects(log), ShouldResemble, []string{":tests: topic work"})
+
+		log, err = r.Log("topic")
+		So(err, ShouldBeNil)
+		So(subjects(log), ShouldResemble, []string{
+			":tests: topic work", ":bugfix: fix it", ":docs: readme", ":initial: start",
+		})
+	}
+
+	Convey("Given a repository with only loose objects", t, func() {
+		r, err := OpenDir(filepath.Join(dir))
+		So(err, ShouldBeNil)
+		check(r)
+	})
+
+	Convey("Given a repository that has been packed", t, func() {
+		gitCmd(t, dir, "gc", "-q", "--aggressive")
+		gitCmd(t, dir, "pack-refs", "--all")
+		_, err := os.Stat(filepath.Join(dir, ".git", "refs", "heads", "main"))
+		So(os.IsNotExist(err), ShouldBeTrue)
+		r, err := OpenDir(dir)
+		So(err, ShouldBeNil)
+		check(r)
+		refs, err := r.Refs()
+		So(err, ShouldBeNil)
+		So(refs, ShouldContainKey, "refs/heads/topic")
+	})
+
+	Convey("Given a linked worktree", t, func() {
+		wt := filepath.Join(dir, "wt")
+		gitCmd(t, dir, "worktree", "add", "-q", wt, "topic")
+		r, err := OpenDir(filepath.Join(wt))
+		So(err, ShouldBeNil)
+		So(r.CommonDir, ShouldEqual, filepath.Join(dir, ".git"))
+		So(r.WorkTree(), ShouldEqual, wt)
+		ref, err := r.Symref("HEAD")
+		So(err, ShouldBeNil)
+		So(ref, ShouldEqual, "refs/heads/topic")
+	})
+
+	Convey("Given a shallow clone", t, func() {
+		clone, err := ioutil.TempDir("", "lipstick-shallow")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(clone)
+		gitCmd(t, clone, "clone", "-q", "--depth", "2", "--branch", "main", "file://"+dir, ".")
+		r, err := OpenDir(clone)
+		So(err, ShouldBeNil)
+
+		log, err := r.Log("HEAD")
+		So(err, ShouldBeNil)
+		So(subjects(log), ShouldResemble, []string{":bugfix: fix it", ":docs: readme"})
+		log, err = r.Log("HEAD~1..HEAD")
+		So(err, ShouldBeNil)
+		So(subjects(log), ShouldResemble, []string{":bugfix: fix it"})
+		So(log[0].Parents, ShouldHaveLength, 1)
+	})
+
+	Convey("Given a note written natively", t, func() {
+		r, err := OpenDir(dir)
+		So(err, ShouldBeNil)
+		head, err := r.Resolve("HEAD")
+		So(err, ShouldBeNil)
+		So(r.AddNote("refs/notes/test", head, "Kind: bugfix\n"), ShouldBeNil)
+		So(gitCmd(t, dir, "notes", "--ref", "test", "show", "HEAD"), ShouldEqual, "Kind: bugfix")
+		note, err := r.Note("refs/notes/test", head)
+		So(err, ShouldBeNil)
+		So(note, ShouldEqual, "Kind: bugfix\n")
+		_, err = r.Note("refs/notes/test", mustResolve(t, r, "HEAD~1"))
+		So(err, ShouldEqual, ErrNotFound)
+	})
+
+	Convey("Given staged changes", t, func() {
+		os.MkdirAll(filepath.Join(dir, "docs", "api"), 0755)
+		ioutil.WriteFile(filepath.Join(dir, "docs", "api", "index.md"), []byte("# api"), 0644)
+		ioutil.WriteFile(filepath.Join(dir, "file.txt"), []byte("changed"), 0644)
+		ioutil.WriteFile(filepath.Join(dir, "unstaged.txt"), []byte("x"), 0644)
+		gitCmd(t, dir, "add", "docs", "file.txt")
+		want := strings.Split(gitCmd(t, dir, "diff", "--cached", "--name-only"), "\n")
+		r, err := OpenDir(dir)
+		So(err, ShouldBeNil)
+
+		staged, err := r.Staged()
+		So(err, ShouldBeNil)
+		So(staged, ShouldResemble, []string{"docs/api/index.md", "file.txt"})
+		So(staged, ShouldResemble, want)
+
+		gitCmd(t, dir, "update-index", "--index-version", "4")
+		staged, err = r.Staged()
+		So(err, ShouldBeNil)
+		So(staged, ShouldResemble, want)
+	})
+
+	Convey("Given a directory outside any repository", t, func() {
+		_, err := Find(os.TempDir())
+		So(err, ShouldEqual, ErrNotRepository)
+	})
+}
+
+func TestConfig(t *testing.T) {
+	Convey("Given a git config file", t, func() {
+		dir, err := ioutil.TempDir("", "lipstick-config")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "config")
+		ioutil.WriteFile(path, []byte("[user]\n\tname = Someone # comment\n[remote \"origin\"]\n\turl = \"a;b\"\n"), 0644)
+
+		c, err := ReadConfig(path)
+		So(err, ShouldBeNil)
+		So(c.Get("user.name"), ShouldEqual, "Someone")
+		So(c.Get("remote.origin.url"), ShouldEqual, "a;b")
+
+		Convey("Setting and unsetting a key should round trip", func() {
+			So(SetConfig(path, "core.hooksPath", "/tmp/hooks"), ShouldBeNil)
+			So(SetConfig(path, "user.name", "Other"), ShouldBeNil)
+			c, _ := ReadConfig(path)
+			So(c.Get("core.hookspath"), ShouldEqual, "/tmp/hooks")
+			So(c.Get("user.name"), ShouldEqual, "Other")
+			if _, err := exec.LookPath("git"); err == nil {
+				So(gitCmd(t, dir, "config", "--file", path, "core.hooksPath"), ShouldEqual, "/tmp/hooks")
+			}
+
+			So(UnsetConfig(path, "core.hooksPath"), ShouldBeNil)
+			c, _ = ReadConfig(path)
+			So(c.Get("core.hooksPath"), ShouldEqual, "")
+			So(c.Get("remote.origin.url"), ShouldEqual, "a;b")
+		})
+	})
+}
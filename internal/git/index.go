@@ -0,0 +1,172 @@
+package git
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+// IndexEntry is a file staged in the index.
+type IndexEntry struct {
+	Path  string
+	Mode  uint32
+	Hash  Hash
+	Stage int
+}
+
+// IndexPath returns the index file git uses, honouring GIT_INDEX_FILE as
+// set for hooks by git commit -a and git commit <paths>.
+func (r *Repository) IndexPath() string {
+	if p := os.Getenv("GIT_INDEX_FILE"); p != "" {
+		if !filepath.IsAbs(p) {
+			if wt := r.WorkTree(); wt != "" {
+				p = filepath.Join(wt, p)
+			}
+		}
+		return p
+	}
+	return filepath.Join(r.Dir, "index")
+}
+
+// Index reads the entries of the index file at path. Versions 2 to 4 are
+// supported, extensions are ignored.
+func (r *Repository) Index(path string) ([]IndexEntry, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if len(data) < 12 || string(data[:4]) != "DIRC" {
+		return nil, fmt.Errorf("index %s: bad signature", path)
+	}
+	version := binary.BigEndian.Uint32(data[4:8])
+	if version < 2 || version > 4 {
+		return nil, fmt.Errorf("index %s: unsupported version %d", path, version)
+	}
+	count := int(binary.BigEndian.Uint32(data[8:12]))
+	entries := make([]IndexEntry, 0, count)
+	bad := fmt.Errorf("index %s: truncated", path)
+	off := 12
+	prev := ""
+	for i := 0; i < count; i++ {
+		start := off
+		if off+62 > len(data) {
+			return nil, bad
+		}
+		e := IndexEntry{Mode: binary.BigEndian.Uint32(data[off+24 : off+28])}
+		copy(e.Hash[:], data[off+40:off+60])
+		flags := binary.BigEndian.Uint16(data[off+60 : off+62])
+		e.Stage = int(flags>>12) & 3
+		off += 62
+		if version >= 3 && flags&0x4000 != 0 {
+			off += 2
+		}
+		if version == 4 {
+			// The name is stored as the number of bytes to drop from the
+			// end of the previous name and the suffix to append.
+			strip, n := indexVarint(data[off:])
+			if n == 0 || int(strip) > len(prev) {
+				return nil, bad
+			}
+			off += n
+			nul := bytes.IndexByte(data[off:], 0)
+			if nul < 0 {
+				return nil, bad
+			}
+			e.Path = prev[:len(prev)-int(strip)] + string(data[off:off+nul])
+			off += nul + 1
+		} else {
+			nul := bytes.IndexByte(data[off:], 0)
+			if nul < 0 {
+				return nil, bad
+			}
+			e.Path = string(data[off : off+nul])
+			// Entries are padded with NULs to a multiple of eight bytes.
+			off = start + (off-start+nul+8)&^7
+		}
+		prev = e.Path
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// indexVarint decodes the offset encoding used by index version 4 and
+// returns the value and the number of bytes read.
+func indexVarint(b []byte) (uint64, int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+	c := b[0]
+	v := uint64(c & 127)
+	n := 1
+	for c&128 != 0 {
+		if n >= len(b) {
+			return 0, 0
+		}
+		c = b[n]
+		n++
+		v = ((v + 1) << 7) + uint64(c&127)
+	}
+	return v, n
+}
+
+// treeFiles lists every file below tree h by path.
+func (r *Repository) treeFiles(h Hash, prefix string, files map[string]Hash) error {
+	entries, err := r.Tree(h)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		p := path.Join(prefix, e.Name)
+		if e.IsTree() {
+			if err := r.treeFiles(e.Hash, p, files); err != nil {
+				return err
+			}
+		} else {
+			files[p] = e.Hash
+		}
+	}
+	return nil
+}
+
+// Staged returns the paths that differ between HEAD and the index, like
+// git diff --cached --name-only. Every entry is staged before the first
+// commit.
+func (r *Repository) Staged() ([]string, error) {
+	entries, err := r.Index(r.IndexPath())
+	if err != nil {
+		return nil, err
+	}
+	head := map[string]Hash{}
+	if h, err := r.Resolve("HEAD"); err == nil {
+		c, err := r.Commit(h)
+		if err != nil {
+			return nil, err
+		}
+		if err := r.treeFiles(c.Tree, "", head); err != nil {
+			return nil, err
+		}
+	}
+	changed := map[string]bool{}
+	for _, e := range entries {
+		if h, ok := head[e.Path]; !ok || h != e.Hash || e.Stage != 0 {
+			changed[e.Path] = true
+		}
+		delete(head, e.Path)
+	}
+	for p := range head {
+		changed[p] = true
+	}
+	paths := make([]string, 0, len(changed))
+	for p := range changed {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
@@ -0,0 +1,108 @@
+package git
+
+import "strings"
+
+// Note returns the note attached to commit under the notes ref, or
+// ErrNotFound if there is none. Fanned out note trees are supported.
+func (r *Repository) Note(ref string, commit Hash) (string, error) {
+	tip, err := r.Ref(ref)
+	if err != nil {
+		return "", ErrNotFound
+	}
+	c, err := r.Commit(tip)
+	if err != nil {
+		return "", err
+	}
+	h, ok, err := r.findNote(c.Tree, commit.String())
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", ErrNotFound
+	}
+	_, data, err := r.Object(h)
+	return string(data), err
+}
+
+func (r *Repository) findNote(tree Hash, name string) (Hash, bool, error) {
+	entries, err := r.Tree(tree)
+	if err != nil {
+		return ZeroHash, false, err
+	}
+	for _, e := range entries {
+		if e.Name == name && !e.IsTree() {
+			return e.Hash, true, nil
+		}
+		if e.IsTree() && len(e.Name) == 2 && strings.HasPrefix(name, e.Name) {
+			return r.findNote(e.Hash, name[2:])
+		}
+	}
+	return ZeroHash, false, nil
+}
+
+// AddNote attaches text to commit under the notes ref, replacing any
+// existing note, and records the change as a new notes commit.
+func (r *Repository) AddNote(ref string, commit Hash, text string) error {
+	blob, err := r.WriteObject(BlobObject, []byte(text))
+	if err != nil {
+		return err
+	}
+	var parents []Hash
+	var tree Hash
+	oldTip, err := r.Ref(ref)
+	if err == nil {
+		c, err := r.Commit(oldTip)
+		if err != nil {
+			return err
+		}
+		parents = []Hash{oldTip}
+		tree = c.Tree
+	}
+	newTree, err := r.insertNote(tree, commit.String(), blob)
+	if err != nil {
+		return err
+	}
+	sig := r.Committer()
+	c := &Commit{
+		Tree:      newTree,
+		Parents:   parents,
+		Author:    sig,
+		Committer: sig,
+		Message:   "Notes added by 'lipstick'\n",
+	}
+	h, err := r.WriteCommit(c)
+	if err != nil {
+		return err
+	}
+	return r.UpdateRef(ref, h, oldTip)
+}
+
+// insertNote adds or replaces the note blob for name in tree, descending
+// into existing fan-out directories.
+func (r *Repository) insertNote(tree Hash, name string, blob Hash) (Hash, error) {
+	var entries []TreeEntry
+	if !tree.IsZero() {
+		var err error
+		if entries, err = r.Tree(tree); err != nil {
+			return ZeroHash, err
+		}
+	}
+	out := entries[:0:0]
+	for _, e := range entries {
+		if e.IsTree() && len(e.Name) == 2 && strings.HasPrefix(name, e.Name) {
+			sub, err := r.insertNote(e.Hash, name[2:], blob)
+			if err != nil {
+				return ZeroHash, err
+			}
+			e.Hash = sub
+			blob = ZeroHash
+		} else if e.Name == name {
+			continue
+		}
+		out = append(out, e)
+	}
+	if !blob.IsZero() {
+		out = append(out, TreeEntry{Mode: ModeBlob, Name: name, Hash: blob})
+	}
+	return r.WriteTree(out)
+}
@@ -0,0 +1,127 @@
+package git
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// ObjectType is the kind of a git object.
+type ObjectType int
+
+// Object types as stored in pack files.
+const (
+	CommitObject ObjectType = 1
+	TreeObject   ObjectType = 2
+	BlobObject   ObjectType = 3
+	TagObject    ObjectType = 4
+	ofsDelta     ObjectType = 6
+	refDelta     ObjectType = 7
+)
+
+func (t ObjectType) String() string {
+	switch t {
+	case CommitObject:
+		return "commit"
+	case TreeObject:
+		return "tree"
+	case BlobObject:
+		return "blob"
+	case TagObject:
+		return "tag"
+	}
+	return "unknown"
+}
+
+func parseObjectType(s string) (ObjectType, error) {
+	switch s {
+	case "commit":
+		return CommitObject, nil
+	case "tree":
+		return TreeObject, nil
+	case "blob":
+		return BlobObject, nil
+	case "tag":
+		return TagObject, nil
+	}
+	return 0, fmt.Errorf("unknown object type %q", s)
+}
+
+// Object reads the object named h from either the loose object store or
+// one of the pack files.
+func (r *Repository) Object(h Hash) (ObjectType, []byte, error) {
+	t, data, err := r.looseObject(h)
+	if err == nil || !os.IsNotExist(err) {
+		return t, data, err
+	}
+	packs, err := r.packfiles()
+	if err != nil {
+		return 0, nil, err
+	}
+	for _, p := range packs {
+		if off, ok := p.find(h); ok {
+			return p.objectAt(r, off)
+		}
+	}
+	return 0, nil, fmt.Errorf("object %s: %v", h, ErrNotFound)
+}
+
+// HasObject reports whether the object h exists.
+func (r *Repository) HasObject(h Hash) bool {
+	if _, err := os.Stat(r.loosePath(h)); err == nil {
+		return true
+	}
+	packs, err := r.packfiles()
+	if err != nil {
+		return false
+	}
+	for _, p := range packs {
+		if _, ok := p.find(h); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Repository) loosePath(h Hash) string {
+	s := h.String()
+	return filepath.Join(r.CommonDir, "objects", s[:2], s[2:])
+}
+
+func (r *Repository) looseObject(h Hash) (ObjectType, []byte, error) {
+	f, err := os.Open(r.loosePath(h))
+	if err != nil {
+		return 0, nil, err
+	}
+	defer f.Close()
+	z, err := zlib.NewReader(f)
+	if err != nil {
+		return 0, nil, fmt.Errorf("object %s: %v", h, err)
+	}
+	defer z.Close()
+	raw, err := ioutil.ReadAll(z)
+	if err != nil {
+		return 0, nil, fmt.Errorf("object %s: %v", h, err)
+	}
+	nul := bytes.IndexByte(raw, 0)
+	if nul < 0 {
+		return 0, nil, fmt.Errorf("object %s: malformed header", h)
+	}
+	header := bytes.SplitN(raw[:nul], []byte(" "), 2)
+	if len(header) != 2 {
+		return 0, nil, fmt.Errorf("object %s: malformed header", h)
+	}
+	t, err := parseObjectType(string(header[0]))
+	if err != nil {
+		return 0, nil, fmt.Errorf("object %s: %v", h, err)
+	}
+	size, err := strconv.Atoi(string(header[1]))
+	if err != nil || size != len(raw)-nul-1 {
+		return 0, nil, fmt.Errorf("object %s: bad size", h)
+	}
+	return t, raw[nul+1:], nil
+}
@@ -0,0 +1,285 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var errBadIndex = errors.New("unsupported pack index")
+
+// packfile is a pack and its version 2 index. The index is read into memory
+// while the pack itself is read on demand.
+type packfile struct {
+	path    string
+	fanout  [256]uint32
+	names   []byte
+	offsets []byte
+	large   []byte
+}
+
+// packfiles loads the indexes of every pack in objects/pack once.
+func (r *Repository) packfiles() ([]*packfile, error) {
+	r.packOnce.Do(func() {
+		dir := filepath.Join(r.CommonDir, "objects", "pack")
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				r.packErr = err
+			}
+			return
+		}
+		for _, e := range entries {
+			if !strings.HasSuffix(e.Name(), ".idx") {
+				continue
+			}
+			base := strings.TrimSuffix(e.Name(), ".idx")
+			p, err := readPackIndex(filepath.Join(dir, e.Name()))
+			if err != nil {
+				r.packErr = fmt.Errorf("%s: %v", e.Name(), err)
+				return
+			}
+			p.path = filepath.Join(dir, base+".pack")
+			r.packs = append(r.packs, p)
+		}
+	})
+	return r.packs, r.packErr
+}
+
+func readPackIndex(path string) (*packfile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 8+256*4 || !bytes.Equal(data[:4], []byte("\377tOc")) ||
+		binary.BigEndian.Uint32(data[4:8]) != 2 {
+		return nil, errBadIndex
+	}
+	p := &packfile{}
+	for i := range p.fanout {
+		p.fanout[i] = binary.BigEndian.Uint32(data[8+i*4:])
+	}
+	n := int(p.fanout[255])
+	pos := 8 + 256*4
+	if len(data) < pos+n*(20+4+4) {
+		return nil, errBadIndex
+	}
+	p.names = data[pos : pos+n*20]
+	pos += n * 20
+	pos += n * 4 // crc32 values
+	p.offsets = data[pos : pos+n*4]
+	pos += n * 4
+	p.large = data[pos:]
+	return p, nil
+}
+
+// find returns the pack offset of h.
+func (p *packfile) find(h Hash) (int64, bool) {
+	lo := 0
+	if h[0] > 0 {
+		lo = int(p.fanout[h[0]-1])
+	}
+	hi := int(p.fanout[h[0]])
+	i := lo + sort.Search(hi-lo, func(i int) bool {
+		return bytes.Compare(p.names[(lo+i)*20:(lo+i+1)*20], h[:]) >= 0
+	})
+	if i >= hi || !bytes.Equal(p.names[i*20:(i+1)*20], h[:]) {
+		return 0, false
+	}
+	off := binary.BigEndian.Uint32(p.offsets[i*4:])
+	if off&0x80000000 == 0 {
+		return int64(off), true
+	}
+	j := int(off &^ 0x80000000)
+	if len(p.large) < (j+1)*8 {
+		return 0, false
+	}
+	return int64(binary.BigEndian.Uint64(p.large[j*8:])), true
+}
+
+// prefix returns every object in the pack whose name starts with the hex
+// prefix s.
+func (p *packfile) prefix(s string) []Hash {
+	var out []Hash
+	n := int(p.fanout[255])
+	for i := 0; i < n; i++ {
+		var h Hash
+		copy(h[:], p.names[i*20:(i+1)*20])
+		if strings.HasPrefix(h.String(), s) {
+			out = append(out, h)
+		}
+	}
+	return out
+}
+
+// objectAt reads and, if necessary, undeltifies the object at off.
+func (p *packfile) objectAt(r *Repository, off int64) (ObjectType, []byte, error) {
+	f, err := os.Open(p.path)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer f.Close()
+	return p.read(r, f, off, 0)
+}
+
+// maxDeltaDepth bounds delta chains so a corrupt pack cannot loop forever.
+const maxDeltaDepth = 1000
+
+func (p *packfile) read(r *Repository, f *os.File, off int64, depth int) (ObjectType, []byte, error) {
+	if depth > maxDeltaDepth {
+		return 0, nil, fmt.Errorf("%s: delta chain too deep", p.path)
+	}
+	br := bufio.NewReader(io.NewSectionReader(f, off, 1<<62))
+	c, err := br.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	t := ObjectType((c >> 4) & 7)
+	size := uint64(c & 15)
+	shift := uint(4)
+	for c&0x80 != 0 {
+		if c, err = br.ReadByte(); err != nil {
+			return 0, nil, err
+		}
+		size |= uint64(c&0x7f) << shift
+		shift += 7
+	}
+
+	var base []byte
+	var baseType ObjectType
+	switch t {
+	case ofsDelta:
+		c, err := br.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		rel := int64(c & 0x7f)
+		for c&0x80 != 0 {
+			if c, err = br.ReadByte(); err != nil {
+				return 0, nil, err
+			}
+			rel = ((rel + 1) << 7) | int64(c&0x7f)
+		}
+		if baseType, base, err = p.read(r, f, off-rel, depth+1); err != nil {
+			return 0, nil, err
+		}
+	case refDelta:
+		var h Hash
+		if _, err := io.ReadFull(br, h[:]); err != nil {
+			return 0, nil, err
+		}
+		if baseType, base, err = r.Object(h); err != nil {
+			return 0, nil, err
+		}
+	case CommitObject, TreeObject, BlobObject, TagObject:
+	default:
+		return 0, nil, fmt.Errorf("%s: bad object type %d at %d", p.path, t, off)
+	}
+
+	z, err := zlib.NewReader(br)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer z.Close()
+	data := make([]byte, size)
+	if _, err := io.ReadFull(z, data); err != nil {
+		return 0, nil, fmt.Errorf("%s: %v", p.path, err)
+	}
+	if base == nil {
+		return t, data, nil
+	}
+	out, err := applyDelta(base, data)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%s: %v", p.path, err)
+	}
+	return baseType, out, nil
+}
+
+var errBadDelta = errors.New("malformed delta")
+
+// applyDelta rebuilds an object from its base and a delta instruction
+// stream.
+func applyDelta(base, delta []byte) ([]byte, error) {
+	readSize := func() (uint64, error) {
+		var n uint64
+		var shift uint
+		for {
+			if len(delta) == 0 {
+				return 0, errBadDelta
+			}
+			c := delta[0]
+			delta = delta[1:]
+			n |= uint64(c&0x7f) << shift
+			shift += 7
+			if c&0x80 == 0 {
+				return n, nil
+			}
+		}
+	}
+	srcSize, err := readSize()
+	if err != nil {
+		return nil, err
+	}
+	if srcSize != uint64(len(base)) {
+		return nil, errBadDelta
+	}
+	dstSize, err := readSize()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, dstSize)
+	for len(delta) > 0 {
+		op := delta[0]
+		delta = delta[1:]
+		if op&0x80 != 0 {
+			var off, n uint64
+			for i := uint(0); i < 4; i++ {
+				if op&(1<<i) != 0 {
+					if len(delta) == 0 {
+						return nil, errBadDelta
+					}
+					off |= uint64(delta[0]) << (8 * i)
+					delta = delta[1:]
+				}
+			}
+			for i := uint(0); i < 3; i++ {
+				if op&(1<<(4+i)) != 0 {
+					if len(delta) == 0 {
+						return nil, errBadDelta
+					}
+					n |= uint64(delta[0]) << (8 * i)
+					delta = delta[1:]
+				}
+			}
+			if n == 0 {
+				n = 0x10000
+			}
+			if off+n > uint64(len(base)) {
+				return nil, errBadDelta
+			}
+			out = append(out, base[off:off+n]...)
+		} else if op != 0 {
+			n := int(op)
+			if n > len(delta) {
+				return nil, errBadDelta
+			}
+			out = append(out, delta[:n]...)
+			delta = delta[n:]
+		} else {
+			return nil, errBadDelta
+		}
+	}
+	if uint64(len(out)) != dstSize {
+		return nil, errBadDelta
+	}
+	return out, nil
+}
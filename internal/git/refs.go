@@ -0,0 +1,296 @@
+package git
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxSymrefDepth matches git's limit on chains of symbolic refs.
+const maxSymrefDepth = 5
+
+// readRefFile returns the raw contents of a loose ref. HEAD and other
+// pseudo refs live in the per worktree directory, everything else in the
+// common directory.
+func (r *Repository) readRefFile(name string) (string, error) {
+	dir := r.CommonDir
+	if !strings.HasPrefix(name, "refs/") {
+		dir = r.Dir
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// packedRefs reads the packed-refs file. Peeled tag lines are ignored.
+func (r *Repository) packedRefs() (map[string]Hash, error) {
+	refs := map[string]Hash{}
+	f, err := os.Open(filepath.Join(r.CommonDir, "packed-refs"))
+	if os.IsNotExist(err) {
+		return refs, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := s.Text()
+		if line == "" || line[0] == '#' || line[0] == '^' {
+			continue
+		}
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		h, err := ParseHash(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("packed-refs: %v", err)
+		}
+		refs[parts[1]] = h
+	}
+	return refs, s.Err()
+}
+
+// Symref returns the target of a symbolic ref such as HEAD, or an empty
+// string if name is not symbolic.
+func (r *Repository) Symref(name string) (string, error) {
+	data, err := r.readRefFile(name)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(data, "ref: ") {
+		return strings.TrimPrefix(data, "ref: "), nil
+	}
+	return "", nil
+}
+
+// Ref resolves the fully qualified ref name, following symbolic refs and
+// falling back to packed-refs.
+func (r *Repository) Ref(name string) (Hash, error) {
+	for depth := 0; depth < maxSymrefDepth; depth++ {
+		data, err := r.readRefFile(name)
+		if err != nil && !os.IsNotExist(err) {
+			return ZeroHash, err
+		}
+		if err == nil {
+			if strings.HasPrefix(data, "ref: ") {
+				name = strings.TrimPrefix(data, "ref: ")
+				continue
+			}
+			return ParseHash(data)
+		}
+		packed, err := r.packedRefs()
+		if err != nil {
+			return ZeroHash, err
+		}
+		if h, ok := packed[name]; ok {
+			return h, nil
+		}
+		return ZeroHash, fmt.Errorf("ref %s: %v", name, ErrNotFound)
+	}
+	return ZeroHash, fmt.Errorf("ref %s: symbolic ref loop", name)
+}
+
+// Refs lists every loose and packed ref under refs/.
+func (r *Repository) Refs() (map[string]Hash, error) {
+	refs, err := r.packedRefs()
+	if err != nil {
+		return nil, err
+	}
+	root := filepath.Join(r.CommonDir, "refs")
+	err = filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(r.CommonDir, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		h, err := r.Ref(name)
+		if err != nil {
+			return nil
+		}
+		refs[name] = h
+		return nil
+	})
+	return refs, err
+}
+
+// refSearchOrder is the order git uses to expand a short ref name.
+var refSearchOrder = []string{
+	"%s",
+	"refs/%s",
+	"refs/tags/%s",
+	"refs/heads/%s",
+	"refs/remotes/%s",
+	"refs/remotes/%s/HEAD",
+}
+
+// ExpandRef returns the fully qualified name of the short ref name.
+func (r *Repository) ExpandRef(name string) (string, error) {
+	for _, format := range refSearchOrder {
+		full := fmt.Sprintf(format, name)
+		if _, err := r.Ref(full); err == nil {
+			return full, nil
+		}
+	}
+	return "", fmt.Errorf("ref %s: %v", name, ErrNotFound)
+}
+
+// Resolve turns a revision into an object name. It understands full and
+// abbreviated hashes, short and full ref names, and the ~N and ^N suffixes.
+func (r *Repository) Resolve(rev string) (Hash, error) {
+	i := strings.IndexAny(rev, "~^")
+	if i < 0 {
+		return r.resolveName(rev)
+	}
+	h, err := r.resolveName(rev[:i])
+	if err != nil {
+		return ZeroHash, err
+	}
+	rest := rev[i:]
+	for rest != "" {
+		op := rest[0]
+		rest = rest[1:]
+		j := 0
+		for j < len(rest) && rest[j] >= '0' && rest[j] <= '9' {
+			j++
+		}
+		n := 1
+		if j > 0 {
+			n, _ = strconv.Atoi(rest[:j])
+		}
+		rest = rest[j:]
+		if op == '^' {
+			if n == 0 {
+				continue
+			}
+			c, err := r.Commit(h)
+			if err != nil {
+				return ZeroHash, err
+			}
+			if n > len(c.Parents) {
+				return ZeroHash, fmt.Errorf("revision %s: no such parent", rev)
+			}
+			h = c.Parents[n-1]
+			continue
+		}
+		if op != '~' {
+			return ZeroHash, fmt.Errorf("revision %s: bad syntax", rev)
+		}
+		for ; n > 0; n-- {
+			c, err := r.Commit(h)
+			if err != nil {
+				return ZeroHash, err
+			}
+			if len(c.Parents) == 0 {
+				return ZeroHash, fmt.Errorf("revision %s: no such ancestor", rev)
+			}
+			h = c.Parents[0]
+		}
+	}
+	return h, nil
+}
+
+func (r *Repository) resolveName(name string) (Hash, error) {
+	if name == "" || name == "@" {
+		name = "HEAD"
+	}
+	if full, err := r.ExpandRef(name); err == nil {
+		h, err := r.Ref(full)
+		if err != nil {
+			return ZeroHash, err
+		}
+		return r.peel(h)
+	}
+	if len(name) == 40 {
+		if h, err := ParseHash(name); err == nil {
+			return h, nil
+		}
+	}
+	if len(name) >= 4 && isHex(name) {
+		return r.abbrev(strings.ToLower(name))
+	}
+	return ZeroHash, fmt.Errorf("revision %s: %v", name, ErrNotFound)
+}
+
+// peel follows annotated tags to the object they point at.
+func (r *Repository) peel(h Hash) (Hash, error) {
+	for depth := 0; depth < maxSymrefDepth; depth++ {
+		t, data, err := r.Object(h)
+		if err != nil {
+			return ZeroHash, err
+		}
+		if t != TagObject {
+			return h, nil
+		}
+		if !strings.HasPrefix(string(data), "object ") || len(data) < 47 {
+			return ZeroHash, fmt.Errorf("tag %s: malformed", h)
+		}
+		if h, err = ParseHash(string(data[7:47])); err != nil {
+			return ZeroHash, err
+		}
+	}
+	return ZeroHash, fmt.Errorf("tag %s: too deeply nested", h)
+}
+
+// abbrev resolves an unambiguous abbreviated object name.
+func (r *Repository) abbrev(prefix string) (Hash, error) {
+	found := map[Hash]bool{}
+	dir := filepath.Join(r.CommonDir, "objects", prefix[:2])
+	if entries, err := ioutil.ReadDir(dir); err == nil {
+		for _, e := range entries {
+			if strings.HasPrefix(prefix[:2]+e.Name(), prefix) {
+				if h, err := ParseHash(prefix[:2] + e.Name()); err == nil {
+					found[h] = true
+				}
+			}
+		}
+	}
+	packs, err := r.packfiles()
+	if err != nil {
+		return ZeroHash, err
+	}
+	for _, p := range packs {
+		for _, h := range p.prefix(prefix) {
+			found[h] = true
+		}
+	}
+	switch len(found) {
+	case 0:
+		return ZeroHash, fmt.Errorf("revision %s: %v", prefix, ErrNotFound)
+	case 1:
+		for h := range found {
+			return h, nil
+		}
+	}
+	names := []string{}
+	for h := range found {
+		names = append(names, h.String())
+	}
+	sort.Strings(names)
+	return ZeroHash, fmt.Errorf("short object name %s is ambiguous: %s", prefix, strings.Join(names, ", "))
+}
+
+func isHex(s string) bool {
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,143 @@
+// Package git reads objects and refs straight out of a .git directory so
+// lipstick can inspect history without shelling out to the git binary.
+package git
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ErrNotRepository is returned when no .git directory can be found.
+var ErrNotRepository = errors.New("not a git repository (or any of the parent directories): .git")
+
+// ErrNotFound is returned when an object or ref does not exist.
+var ErrNotFound = errors.New("not found")
+
+// Hash is a SHA-1 object name.
+type Hash [20]byte
+
+// ZeroHash is the all zero hash git uses for "no object".
+var ZeroHash Hash
+
+// ParseHash parses a full 40 character hex object name.
+func ParseHash(s string) (Hash, error) {
+	var h Hash
+	if len(s) != 40 {
+		return h, fmt.Errorf("invalid object name %q", s)
+	}
+	if _, err := hex.Decode(h[:], []byte(s)); err != nil {
+		return h, fmt.Errorf("invalid object name %q", s)
+	}
+	return h, nil
+}
+
+// String returns the hex form of the hash.
+func (h Hash) String() string {
+	return hex.EncodeToString(h[:])
+}
+
+// IsZero reports whether h is the zero hash.
+func (h Hash) IsZero() bool {
+	return h == ZeroHash
+}
+
+// Repository is a handle on a .git directory.
+type Repository struct {
+	// Dir is the git directory, for a linked worktree this is the per
+	// worktree directory under .git/worktrees.
+	Dir string
+	// CommonDir holds objects and refs shared between worktrees. It is the
+	// same as Dir for ordinary repositories.
+	CommonDir string
+
+	packOnce sync.Once
+	packs    []*packfile
+	packErr  error
+
+	shallowOnce sync.Once
+	shallow     map[Hash]bool
+	shallowErr  error
+}
+
+// Find walks up from dir looking for a .git directory or a .git file (as
+// used by worktrees and submodules) and returns the git directory.
+func Find(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	for {
+		p := filepath.Join(dir, ".git")
+		if fi, err := os.Stat(p); err == nil {
+			if fi.IsDir() {
+				return p, nil
+			}
+			return readGitFile(p)
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", ErrNotRepository
+		}
+		dir = parent
+	}
+}
+
+// readGitFile follows a "gitdir: <path>" pointer file.
+func readGitFile(p string) (string, error) {
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return "", err
+	}
+	line := strings.TrimSpace(string(data))
+	if !strings.HasPrefix(line, "gitdir: ") {
+		return "", fmt.Errorf("invalid gitfile format: %s", p)
+	}
+	dir := strings.TrimPrefix(line, "gitdir: ")
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(filepath.Dir(p), dir)
+	}
+	return filepath.Clean(dir), nil
+}
+
+// Open opens the git directory gitDir.
+func Open(gitDir string) (*Repository, error) {
+	if _, err := os.Stat(filepath.Join(gitDir, "HEAD")); err != nil {
+		return nil, ErrNotRepository
+	}
+	r := &Repository{Dir: gitDir, CommonDir: gitDir}
+	if data, err := ioutil.ReadFile(filepath.Join(gitDir, "commondir")); err == nil {
+		common := strings.TrimSpace(string(data))
+		if !filepath.IsAbs(common) {
+			common = filepath.Join(gitDir, common)
+		}
+		r.CommonDir = filepath.Clean(common)
+	}
+	return r, nil
+}
+
+// OpenDir finds and opens the repository containing dir.
+func OpenDir(dir string) (*Repository, error) {
+	gitDir, err := Find(dir)
+	if err != nil {
+		return nil, err
+	}
+	return Open(gitDir)
+}
+
+// WorkTree returns the top level of the working tree, or an empty string
+// for bare repositories.
+func (r *Repository) WorkTree() string {
+	if data, err := ioutil.ReadFile(filepath.Join(r.Dir, "gitdir")); err == nil {
+		return filepath.Dir(strings.TrimSpace(string(data)))
+	}
+	if filepath.Base(r.Dir) == ".git" {
+		return filepath.Dir(r.Dir)
+	}
+	return ""
+}
@@ -0,0 +1,104 @@
+package git
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// File modes used in tree entries.
+const (
+	ModeTree = "40000"
+	ModeBlob = "100644"
+)
+
+// TreeEntry is a single entry of a tree object.
+type TreeEntry struct {
+	Mode string
+	Name string
+	Hash Hash
+}
+
+// IsTree reports whether the entry is a subdirectory.
+func (e TreeEntry) IsTree() bool {
+	return e.Mode == ModeTree || e.Mode == "040000"
+}
+
+// Tree reads the tree object h.
+func (r *Repository) Tree(h Hash) ([]TreeEntry, error) {
+	t, data, err := r.Object(h)
+	if err != nil {
+		return nil, err
+	}
+	if t != TreeObject {
+		return nil, fmt.Errorf("object %s is a %s, not a tree", h, t)
+	}
+	var entries []TreeEntry
+	for len(data) > 0 {
+		sp := bytes.IndexByte(data, ' ')
+		nul := bytes.IndexByte(data, 0)
+		if sp < 0 || nul < sp || len(data) < nul+21 {
+			return nil, fmt.Errorf("tree %s: malformed entry", h)
+		}
+		e := TreeEntry{Mode: string(data[:sp]), Name: string(data[sp+1 : nul])}
+		copy(e.Hash[:], data[nul+1:nul+21])
+		entries = append(entries, e)
+		data = data[nul+21:]
+	}
+	return entries, nil
+}
+
+// File reads the file at path, relative to the top of the tree of commit.
+func (r *Repository) File(commit Hash, path string) ([]byte, error) {
+	c, err := r.Commit(commit)
+	if err != nil {
+		return nil, err
+	}
+	h := c.Tree
+	for _, name := range strings.Split(strings.Trim(path, "/"), "/") {
+		entries, err := r.Tree(h)
+		if err != nil {
+			return nil, fmt.Errorf("path %s: %v", path, ErrNotFound)
+		}
+		found := false
+		for _, e := range entries {
+			if e.Name == name {
+				h, found = e.Hash, true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("path %s: %v", path, ErrNotFound)
+		}
+	}
+	t, data, err := r.Object(h)
+	if err != nil {
+		return nil, err
+	}
+	if t != BlobObject {
+		return nil, fmt.Errorf("path %s is a %s, not a file", path, t)
+	}
+	return data, nil
+}
+
+// WriteTree stores a tree built from entries, sorting them the way git
+// expects.
+func (r *Repository) WriteTree(entries []TreeEntry) (Hash, error) {
+	sorted := append([]TreeEntry(nil), entries...)
+	sortKey := func(e TreeEntry) string {
+		if e.IsTree() {
+			return e.Name + "/"
+		}
+		return e.Name
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sortKey(sorted[i]) < sortKey(sorted[j])
+	})
+	var b bytes.Buffer
+	for _, e := range sorted {
+		fmt.Fprintf(&b, "%s %s\x00", e.Mode, e.Name)
+		b.Write(e.Hash[:])
+	}
+	return r.WriteObject(TreeObject, b.Bytes())
+}
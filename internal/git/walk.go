@@ -0,0 +1,171 @@
+package git
+
+import (
+	"container/heap"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// commitQueue orders commits newest first by committer date, like the
+// default order of git log.
+type commitQueue []*Commit
+
+func (q commitQueue) Len() int { return len(q) }
+func (q commitQueue) Less(i, j int) bool {
+	return q[i].Committer.When.After(q[j].Committer.When)
+}
+func (q commitQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *commitQueue) Push(x interface{}) { *q = append(*q, x.(*Commit)) }
+func (q *commitQueue) Pop() interface{} {
+	old := *q
+	c := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return c
+}
+
+// shallowCommits loads the commits listed in the shallow file of a shallow
+// clone once. Their parents are not in the repository.
+func (r *Repository) shallowCommits() (map[Hash]bool, error) {
+	r.shallowOnce.Do(func() {
+		data, err := ioutil.ReadFile(filepath.Join(r.CommonDir, "shallow"))
+		if err != nil {
+			if !os.IsNotExist(err) {
+				r.shallowErr = err
+			}
+			return
+		}
+		r.shallow = map[Hash]bool{}
+		for _, l := range strings.Fields(string(data)) {
+			h, err := ParseHash(l)
+			if err != nil {
+				r.shallowErr = fmt.Errorf("shallow: %v", err)
+				return
+			}
+			r.shallow[h] = true
+		}
+	})
+	return r.shallow, r.shallowErr
+}
+
+// Walk calls fn for every commit reachable from include but not from
+// exclude, newest first. Returning false from fn stops the walk. The
+// commits at the edge of a shallow clone are walked as if they had no
+// parents.
+func (r *Repository) Walk(include, exclude []Hash, fn func(*Commit) bool) error {
+	shallow, err := r.shallowCommits()
+	if err != nil {
+		return err
+	}
+	hidden := map[Hash]bool{}
+	stack := append([]Hash(nil), exclude...)
+	for len(stack) > 0 {
+		h := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if hidden[h] {
+			continue
+		}
+		hidden[h] = true
+		c, err := r.Commit(h)
+		if err != nil {
+			return err
+		}
+		if !shallow[h] {
+			stack = append(stack, c.Parents...)
+		}
+	}
+
+	seen := map[Hash]bool{}
+	q := &commitQueue{}
+	for _, h := range include {
+		if hidden[h] || seen[h] {
+			continue
+		}
+		seen[h] = true
+		c, err := r.Commit(h)
+		if err != nil {
+			return err
+		}
+		heap.Push(q, c)
+	}
+	for q.Len() > 0 {
+		c := heap.Pop(q).(*Commit)
+		if !fn(c) {
+			return nil
+		}
+		if shallow[c.Hash] {
+			continue
+		}
+		for _, p := range c.Parents {
+			if hidden[p] || seen[p] {
+				continue
+			}
+			seen[p] = true
+			pc, err := r.Commit(p)
+			if err != nil {
+				return err
+			}
+			heap.Push(q, pc)
+		}
+	}
+	return nil
+}
+
+// Log returns the commits selected by a revision range, newest first. The
+// range may be a single revision, "A..B", or a list such as "B ^A".
+func (r *Repository) Log(spec string) ([]*Commit, error) {
+	include, exclude, err := r.ParseRange(spec)
+	if err != nil {
+		return nil, err
+	}
+	var out []*Commit
+	err = r.Walk(include, exclude, func(c *Commit) bool {
+		out = append(out, c)
+		return true
+	})
+	return out, err
+}
+
+// ParseRange splits a revision range into the commits to include and the
+// commits whose ancestry is excluded.
+func (r *Repository) ParseRange(spec string) (include, exclude []Hash, err error) {
+	for _, part := range strings.Fields(spec) {
+		if i := strings.Index(part, ".."); i >= 0 {
+			from, to := part[:i], part[i+2:]
+			fh, err := r.Resolve(from)
+			if err != nil {
+				return nil, nil, err
+			}
+			th, err := r.Resolve(to)
+			if err != nil {
+				return nil, nil, err
+			}
+			exclude = append(exclude, fh)
+			include = append(include, th)
+			continue
+		}
+		if strings.HasPrefix(part, "^") {
+			h, err := r.Resolve(part[1:])
+			if err != nil {
+				return nil, nil, err
+			}
+			exclude = append(exclude, h)
+			continue
+		}
+		h, err := r.Resolve(part)
+		if err != nil {
+			return nil, nil, err
+		}
+		include = append(include, h)
+	}
+	if len(include) == 0 {
+		h, err := r.Resolve("HEAD")
+		if err != nil {
+			return nil, nil, err
+		}
+		include = append(include, h)
+	}
+	return include, exclude, nil
+}
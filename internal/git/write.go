@@ -0,0 +1,115 @@
+package git
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Encode serialises the commit in git's canonical object format.
+func (c *Commit) Encode() []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "tree %s\n", c.Tree)
+	for _, p := range c.Parents {
+		fmt.Fprintf(&b, "parent %s\n", p)
+	}
+	fmt.Fprintf(&b, "author %s\n", c.Author)
+	fmt.Fprintf(&b, "committer %s\n", c.Committer)
+	for _, h := range c.Extra {
+		fmt.Fprintf(&b, "%s %s\n", h.Key, strings.Replace(h.Value, "\n", "\n ", -1))
+	}
+	b.WriteString("\n")
+	b.WriteString(c.Message)
+	return b.Bytes()
+}
+
+// WriteObject stores data as a loose object and returns its name. Objects
+// that already exist are left untouched.
+func (r *Repository) WriteObject(t ObjectType, data []byte) (Hash, error) {
+	header := fmt.Sprintf("%s %d\x00", t, len(data))
+	sum := sha1.New()
+	sum.Write([]byte(header))
+	sum.Write(data)
+	var h Hash
+	copy(h[:], sum.Sum(nil))
+	if r.HasObject(h) {
+		return h, nil
+	}
+
+	var z bytes.Buffer
+	w := zlib.NewWriter(&z)
+	w.Write([]byte(header))
+	w.Write(data)
+	if err := w.Close(); err != nil {
+		return h, err
+	}
+	path := r.loosePath(h)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return h, err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "tmp_obj_")
+	if err != nil {
+		return h, err
+	}
+	if _, err := tmp.Write(z.Bytes()); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return h, err
+	}
+	tmp.Close()
+	os.Chmod(tmp.Name(), 0444)
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return h, err
+	}
+	return h, nil
+}
+
+// WriteCommit stores c and sets c.Hash to the new object name.
+func (r *Repository) WriteCommit(c *Commit) (Hash, error) {
+	h, err := r.WriteObject(CommitObject, c.Encode())
+	if err == nil {
+		c.Hash = h
+	}
+	return h, err
+}
+
+// UpdateRef points the fully qualified ref name at h. If old is not the
+// zero hash the update only happens when the ref currently points at old,
+// mirroring git update-ref's safety check.
+func (r *Repository) UpdateRef(name string, h, old Hash) error {
+	dir := r.CommonDir
+	if !strings.HasPrefix(name, "refs/") {
+		dir = r.Dir
+	}
+	path := filepath.Join(dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	lock := path + ".lock"
+	f, err := os.OpenFile(lock, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to lock ref %s: %v", name, err)
+	}
+	defer os.Remove(lock)
+	if !old.IsZero() {
+		cur, err := r.Ref(name)
+		if err != nil || cur != old {
+			f.Close()
+			return fmt.Errorf("ref %s changed while it was being updated", name)
+		}
+	}
+	if _, err := fmt.Fprintf(f, "%s\n", h); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(lock, path)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// jj does not run hooks, so lipstick wraps the editor jj opens for commit
+// descriptions and rewrites the description once the editor exits.
+const (
+	jjBegin      = "# lipstick: begin\n"
+	jjEnd        = "# lipstick: end\n"
+	jjEditorLine = "editor = [\"lipstick\", \"jj-editor\"]\n"
+	// jjDescriptionExt is the extension jj gives description files, used to
+	// leave other files opened through ui.editor alone.
+	jjDescriptionExt = ".jjdescription"
+)
+
+var (
+	jjUITable  = regexp.MustCompile(`(?m)^\[ui\][ \t]*$`)
+	jjEditorKV = regexp.MustCompile(`(?m)^[ \t]*editor[ \t]*=`)
+)
+
+// jjVCS configures lipstick as the editor in the repo's jj config.
+type jjVCS struct {
+	root string
+}
+
+func (j jjVCS) name() string { return "jujutsu" }
+
+func (j jjVCS) config() string { return filepath.Join(j.root, ".jj", "repo", "config.toml") }
+
+func (j jjVCS) install(cfg *Config) error {
+	d, err := readFile(j.config())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	rc := string(d)
+	if strings.Contains(rc, jjBegin) {
+		return nil
+	}
+	block := jjBegin + jjEditorLine + jjEnd
+	if loc := jjUITable.FindStringIndex(rc); loc != nil {
+		// Only look for an editor key inside the existing [ui] table.
+		table := rc[loc[1]:]
+		if next := strings.Index(table, "\n["); next >= 0 {
+			table = table[:next]
+		}
+		if jjEditorKV.MatchString(table) {
+			return fmt.Errorf("ui.editor is already set in %s, set it to [\"lipstick\", \"jj-editor\"] by hand", j.config())
+		}
+		rc = rc[:loc[1]] + "\n" + strings.TrimSuffix(block, "\n") + rc[loc[1]:]
+	} else {
+		if rc != "" && !strings.HasSuffix(rc, "\n") {
+			rc += "\n"
+		}
+		rc += "[ui]\n" + block
+	}
+	return writeFile(j.config(), rc)
+}
+
+func (j jjVCS) uninstall() error {
+	block := jjBegin + jjEditorLine + jjEnd
+	d, err := readFile(j.config())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	// The block is either appended at the end with its own [ui] table or
+	// inserted below an existing one.
+	if rc := string(d); strings.HasSuffix(rc, "[ui]\n"+block) {
+		rc = strings.TrimSuffix(rc, "[ui]\n"+block)
+		return writeFile(j.config(), rc)
+	}
+	return removeHook(j.config(), "\n"+strings.TrimSuffix(block, "\n"))
+}
+
+func (j jjVCS) status() (bool, string, error) {
+	d, err := readFile(j.config())
+	if os.IsNotExist(err) {
+		return false, j.config(), nil
+	} else if err != nil {
+		return false, j.config(), err
+	}
+	return strings.Contains(string(d), jjBegin), j.config(), nil
+}
+
+// userEditor returns the editor the user would normally get, the same
+// variables jj falls back on when ui.editor is unset.
+func userEditor() []string {
+	for _, env := range []string{"VISUAL", "EDITOR"} {
+		if e := strings.Fields(os.Getenv(env)); len(e) > 0 {
+			return e
+		}
+	}
+	return []string{"vi"}
+}
+
+// jjEditor opens path in the user's editor and then applies the mappings
+// to the description jj is waiting for.
+func jjEditor(dir, path string) error {
+	editor := userEditor()
+	cmd := exec.Command(editor[0], append(editor[1:], path)...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+	if !strings.HasSuffix(path, jjDescriptionExt) {
+		return nil
+	}
+	cfg, err := loadEmojiMap(dir)
+	if err != nil {
+		return err
+	}
+	d, err := readFile(path)
+	if err != nil {
+		return err
+	}
+	msg, _ := annotate(cfg, string(d))
+	if msg == string(d) {
+		return nil
+	}
+	return writeFile(path, msg)
+}
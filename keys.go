@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Match policies decide which tokens match a key.
+const (
+	// matchExact matches only the key as written.
+	matchExact = "exact"
+	// matchCaseInsensitive ignores case, so :BugFix: matches bugfix.
+	matchCaseInsensitive = "case-insensitive"
+	// matchNormalized also treats camelCase, kebab-case and snake_case as
+	// the same, so :remove-logging: matches removeLogging.
+	matchNormalized = "normalized"
+)
+
+// Policy holds the settings of the [policy] table.
+type Policy struct {
+	Match       string `toml:"match" json:"match" yaml:"match"`
+	Autocorrect string `toml:"autocorrect" json:"autocorrect" yaml:"autocorrect"`
+}
+
+func (p Policy) match() string {
+	if p.Match == "" {
+		return matchExact
+	}
+	return p.Match
+}
+
+// checkPolicy returns an error for settings lipstick does not know.
+func checkPolicy(p Policy) error {
+	switch p.match() {
+	case matchExact, matchCaseInsensitive, matchNormalized:
+	default:
+		return fmt.Errorf("unknown match %q, use %s, %s or %s", p.Match, matchExact, matchCaseInsensitive, matchNormalized)
+	}
+	switch p.autocorrect() {
+	case autocorrectOff, autocorrectApply, autocorrectPrompt, autocorrectFail:
+	default:
+		return fmt.Errorf("unknown autocorrect %q, use %s, %s, %s or %s", p.Autocorrect, autocorrectOff, autocorrectApply, autocorrectPrompt, autocorrectFail)
+	}
+	return nil
+}
+
+// normalizeKey returns the form of key that is compared under the match
+// policy. Normalizing starts a new word at every upper case letter after a
+// lower case letter or digit and at every '-' or '_'.
+func normalizeKey(match, key string) string {
+	switch match {
+	case matchCaseInsensitive:
+		return strings.ToLower(key)
+	case matchNormalized:
+		var b strings.Builder
+		for i := 0; i < len(key); i++ {
+			c := key[i]
+			switch {
+			case c == '_':
+				c = '-'
+			case 'A' <= c && c <= 'Z':
+				if i > 0 && ('a' <= key[i-1] && key[i-1] <= 'z' || '0' <= key[i-1] && key[i-1] <= '9') {
+					b.WriteByte('-')
+				}
+				c += 'a' - 'A'
+			}
+			b.WriteByte(c)
+		}
+		return b.String()
+	}
+	return key
+}
+
+// indexKeys records the normalized form of every key for lookup. When
+// several keys share a form the alphabetically first one is used.
+func (cfg *Config) indexKeys() {
+	match := cfg.Policy.match()
+	if match == matchExact {
+		cfg.keys = nil
+		return
+	}
+	cfg.keys = map[string]string{}
+	for key := range cfg.Words {
+		form := normalizeKey(match, key)
+		if cur, ok := cfg.keys[form]; !ok || key < cur {
+			cfg.keys[form] = key
+		}
+	}
+}
+
+// lookup returns the key the token text matches under the match policy.
+// A key written exactly always matches itself.
+func (cfg *Config) lookup(token string) (string, bool) {
+	if _, ok := cfg.Words[token]; ok {
+		return token, true
+	}
+	match := cfg.Policy.match()
+	if match == matchExact {
+		return "", false
+	}
+	form := normalizeKey(match, token)
+	if cfg.keys != nil {
+		key, ok := cfg.keys[form]
+		return key, ok
+	}
+	// Configs built by hand have no index.
+	key, ok := "", false
+	for k := range cfg.Words {
+		if normalizeKey(match, k) == form && (!ok || k < key) {
+			key, ok = k, true
+		}
+	}
+	return key, ok
+}
+
+// longestToken returns the length of the longest token text that can
+// match a key. Normalizing only adds bytes, so that is the longest form.
+func (cfg *Config) longestToken() int {
+	match := cfg.Policy.match()
+	n := 0
+	for key := range cfg.Words {
+		if l := len(normalizeKey(match, key)); l > n {
+			n = l
+		}
+	}
+	return n
+}
+
+// collisions returns the groups of keys that match the same tokens under
+// the match policy, each sorted and in the order of their first key.
+func collisions(cfg *Config) [][]string {
+	match := cfg.Policy.match()
+	forms := map[string][]string{}
+	for key := range cfg.Words {
+		form := normalizeKey(match, key)
+		forms[form] = append(forms[form], key)
+	}
+	var groups [][]string
+	for _, keys := range forms {
+		if len(keys) > 1 {
+			sort.Strings(keys)
+			groups = append(groups, keys)
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i][0] < groups[j][0] })
+	return groups
+}
+
+// checkConfig reports the keys of dir that collide under the match
+// policy, with the file each one came from.
+func checkConfig(dir string, w io.Writer) error {
+	cfg, err := loadEmojiMap(dir)
+	if err != nil {
+		return err
+	}
+	n := reportCollisions(w, cfg, ":")
+	for _, name := range cfg.tableNames() {
+		n += reportCollisions(w, cfg.table(name), cfg.Tables[name].Delimiter)
+	}
+	if n > 0 {
+		return &cliError{exitConfig, fmt.Errorf("%d groups of keys collide under match = %q", n, cfg.Policy.match())}
+	}
+	return nil
+}
+
+// reportCollisions writes the keys of cfg that collide, as tokens with the
+// delimiter d, and returns the number of groups.
+func reportCollisions(w io.Writer, cfg *Config, d string) int {
+	groups := collisions(cfg)
+	for _, keys := range groups {
+		described := make([]string, len(keys))
+		for i, key := range keys {
+			described[i] = fmt.Sprintf("%s%s%s (%s)", d, key, d, cfg.Sources[key])
+		}
+		fmt.Fprintf(w, "%s match the same tokens, %s%s%s is used\n", strings.Join(described, ", "), d, keys[0], d)
+	}
+	return len(groups)
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/jesusrmoreno/lipstick/internal/git"
+)
+
+// Output modes decide where the kind of a commit is recorded.
+const (
+	// modeEmoji replaces the :key: token with its mapping, the default.
+	modeEmoji = "emoji"
+	// modeTrailer removes the token and adds a "Kind: key" trailer.
+	modeTrailer = "trailer"
+	// modeNotes removes the token and stores the kind in a git note.
+	modeNotes = "notes"
+)
+
+const (
+	defaultTrailer  = "Kind"
+	defaultNotesRef = "refs/notes/lipstick"
+	// pendingKindsFile holds the kinds found by the commit-msg hook until
+	// the post-commit hook can attach them to the new commit as a note.
+	pendingKindsFile = "LIPSTICK_KINDS"
+)
+
+// Output controls how the kind of a commit is recorded.
+type Output struct {
+	Mode     string `toml:"mode" json:"mode" yaml:"mode"`
+	Trailer  string `toml:"trailer" json:"trailer" yaml:"trailer"`
+	NotesRef string `toml:"notesRef" json:"notesRef" yaml:"notesRef"`
+}
+
+func (o Output) mode() string {
+	if o.Mode == "" {
+		return modeEmoji
+	}
+	return o.Mode
+}
+
+func (o Output) trailer() string {
+	if o.Trailer == "" {
+		return defaultTrailer
+	}
+	return o.Trailer
+}
+
+func (o Output) notesRef() string {
+	if o.NotesRef == "" {
+		return defaultNotesRef
+	}
+	return o.NotesRef
+}
+
+// tokenPattern matches anything shaped like a :key: token.
+var tokenPattern = regexp.MustCompile(`:[A-Za-z0-9_+-]+:`)
+
+// stripKinds removes every known :key: token from msg along with one
+// adjacent space and returns the keys in the order they appeared.
+func stripKinds(cfg *Config, msg string) (string, []string) {
+	var kinds []string
+	var b strings.Builder
+	last := 0
+	for _, loc := range tokenPattern.FindAllStringIndex(msg, -1) {
+		key, ok := cfg.lookup(msg[loc[0]+1 : loc[1]-1])
+		if !ok || loc[0] < last {
+			continue
+		}
+		kinds = appendUnique(kinds, key)
+		start, end := loc[0], loc[1]
+		if end < len(msg) && msg[end] == ' ' {
+			end++
+		} else if start > last && msg[start-1] == ' ' {
+			start--
+		}
+		b.WriteString(msg[last:start])
+		last = end
+	}
+	b.WriteString(msg[last:])
+	return b.String(), kinds
+}
+
+var trailerLine = regexp.MustCompile(`^[A-Za-z0-9-]+: `)
+
+// addTrailers appends "key: kind" trailers to msg, joining an existing
+// trailer block when there is one and skipping trailers already present.
+func addTrailers(msg, key string, kinds []string) string {
+	if len(kinds) == 0 {
+		return msg
+	}
+	newline := strings.HasSuffix(msg, "\n")
+	body := strings.TrimRight(msg, "\n")
+	lines := strings.Split(body, "\n")
+	var add []string
+	for _, kind := range kinds {
+		t := key + ": " + kind
+		present := false
+		for _, l := range lines {
+			if l == t {
+				present = true
+			}
+		}
+		if !present {
+			add = append(add, t)
+		}
+	}
+	if len(add) == 0 {
+		return msg
+	}
+
+	// The last paragraph is a trailer block if every line in it looks like
+	// a trailer, in which case the new trailers join it.
+	block := lines[len(lines)-1] != ""
+	paragraph := lines
+	if i := strings.LastIndex(body, "\n\n"); i >= 0 {
+		paragraph = strings.Split(body[i+2:], "\n")
+	} else {
+		block = false
+	}
+	for _, l := range paragraph {
+		if !trailerLine.MatchString(l) {
+			block = false
+		}
+	}
+	sep := "\n\n"
+	if block {
+		sep = "\n"
+	} else if body == "" {
+		sep = ""
+	}
+	out := body + sep + strings.Join(add, "\n")
+	if newline {
+		out += "\n"
+	}
+	return out
+}
+
+// annotate applies the configured output mode to msg. It returns the new
+// message and, in notes mode, the kinds that still need to be recorded.
+// The other tables are replaced in every mode.
+func annotate(cfg *Config, msg string) (string, []string) {
+	switch cfg.Output.mode() {
+	case modeTrailer:
+		out, kinds := stripKinds(cfg, msg)
+		return addTrailers(replaceTables(cfg, out), cfg.Output.trailer(), kinds), nil
+	case modeNotes:
+		out, kinds := stripKinds(cfg, msg)
+		return replaceTables(cfg, out), kinds
+	}
+	return replace(cfg, msg), nil
+}
+
+// formatNote renders kinds the way they are stored in a note, one trailer
+// style line per kind so notes and trailers read back the same way.
+func formatNote(cfg *Config, kinds []string) string {
+	var b strings.Builder
+	for _, k := range kinds {
+		b.WriteString(cfg.Output.trailer() + ": " + k + "\n")
+	}
+	return b.String()
+}
+
+// parseKindLines returns the values of every "key: value" line in text.
+func parseKindLines(key, text string) []string {
+	var kinds []string
+	prefix := strings.ToLower(key) + ":"
+	for _, l := range strings.Split(text, "\n") {
+		if strings.HasPrefix(strings.ToLower(l), prefix) {
+			kinds = appendUnique(kinds, strings.TrimSpace(l[len(prefix):]))
+		}
+	}
+	return kinds
+}
+
+// readKinds recovers the kinds of a commit from wherever lipstick may have
+// put them: trailers, a note under the configured ref, or the mapped value
+// or raw token in the subject.
+func readKinds(cfg *Config, repo *git.Repository, c *git.Commit) []string {
+	kinds := parseKindLines(cfg.Output.trailer(), c.Message)
+	if note, err := repo.Note(cfg.Output.notesRef(), c.Hash); err == nil {
+		for _, k := range parseKindLines(cfg.Output.trailer(), note) {
+			kinds = appendUnique(kinds, k)
+		}
+	}
+
+	// Several keys may share a value, pick the alphabetically first one so
+	// the answer does not depend on map order.
+	byValue := map[string]string{}
+	for key, value := range cfg.Words {
+		if cur, ok := byValue[value]; !ok || key < cur {
+			byValue[value] = key
+		}
+	}
+	subject := strings.SplitN(c.Message, "\n", 2)[0]
+	for _, tok := range tokenPattern.FindAllString(subject, -1) {
+		if key, ok := byValue[tok]; ok {
+			kinds = appendUnique(kinds, key)
+		} else if key, ok := cfg.lookup(tok[1 : len(tok)-1]); ok {
+			kinds = appendUnique(kinds, key)
+		}
+	}
+	return kinds
+}
+
+func appendUnique(list []string, s string) []string {
+	for _, v := range list {
+		if v == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
+
+// savePendingKinds records kinds for the post-commit hook of the repository
+// containing dir. Outside of a git repository there is nothing to attach a
+// note to, so it does nothing.
+func savePendingKinds(dir string, kinds []string) error {
+	gitDir, err := git.Find(dir)
+	if err != nil {
+		return nil
+	}
+	path := filepath.Join(gitDir, pendingKindsFile)
+	if len(kinds) == 0 {
+		removeFile(path)
+		return nil
+	}
+	return writeFile(path, strings.Join(kinds, "\n")+"\n")
+}
+
+// attachPendingNote is run from the post-commit hook and stores the kinds
+// saved by the commit-msg hook as a note on HEAD.
+func attachPendingNote(dir string) error {
+	repo, err := git.OpenDir(dir)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(repo.Dir, pendingKindsFile)
+	data, err := readFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer removeFile(path)
+	cfg, err := loadEmojiMap(dir)
+	if err != nil {
+		return err
+	}
+	head, err := repo.Resolve("HEAD")
+	if err != nil {
+		return err
+	}
+	kinds := strings.Fields(string(data))
+	if dryRun != nil {
+		log.Printf("would add a note with %s to %s", strings.Join(kinds, ", "), head.String()[:7])
+		return nil
+	}
+	return repo.AddNote(cfg.Output.notesRef(), head, formatNote(cfg, kinds))
+}
+
+// kindStats counts the kinds of every commit in spec. Commits without a
+// recognisable kind are counted under an empty key.
+func kindStats(cfg *Config, repo *git.Repository, spec string) (map[string]int, int, error) {
+	counts := map[string]int{}
+	commits, err := repo.Log(spec)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, c := range commits {
+		kinds := readKinds(cfg, repo, c)
+		if len(kinds) == 0 {
+			counts[""]++
+		}
+		for _, k := range kinds {
+			counts[k]++
+		}
+	}
+	return counts, len(commits), nil
+}
+
+// sortedByCount returns the keys of counts, most frequent first.
+func sortedByCount(counts map[string]int) []string {
+	keys := []string{}
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
+
+// showStats prints how often each kind was used in spec.
+func showStats(dir, spec string) error {
+	repo, err := git.OpenDir(dir)
+	if err != nil {
+		return err
+	}
+	cfg, err := loadEmojiMap(dir)
+	if err != nil {
+		return err
+	}
+	counts, total, err := kindStats(cfg, repo, spec)
+	if err != nil {
+		return err
+	}
+	var maxLen int
+	for key := range counts {
+		if len(key) > maxLen {
+			maxLen = len(key)
+		}
+	}
+	fmt.Println()
+	for _, key := range sortedByCount(counts) {
+		display := ":" + key + ":"
+		if key == "" {
+			display = "(none)"
+		}
+		fmt.Println(rightPad(display, " ", maxLen+4-len(display)), counts[key])
+	}
+	fmt.Println()
+	fmt.Println(total, "commits")
+	return nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// problem is something wrong with a commit message. Lines and columns are
+// zero based byte offsets into the message.
+type problem struct {
+	Line    int    `json:"line"`
+	Start   int    `json:"start"`
+	End     int    `json:"end"`
+	Message string `json:"message"`
+}
+
+// lintMessage checks msg against cfg, including the rules of its kinds.
+// Comment lines, as git strips them, are ignored.
+func lintMessage(cfg *Config, msg string) []problem {
+	known := map[string]bool{}
+	for _, value := range cfg.Words {
+		known[value] = true
+	}
+	problems := []problem{}
+	for n, line := range strings.Split(msg, "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, loc := range tokenPattern.FindAllStringIndex(line, -1) {
+			token := line[loc[0]:loc[1]]
+			if _, ok := cfg.lookup(token[1 : len(token)-1]); ok || known[token] {
+				continue
+			}
+			problems = append(problems, problem{
+				Line:    n,
+				Start:   loc[0],
+				End:     loc[1],
+				Message: fmt.Sprintf("unknown token %s", token),
+			})
+		}
+	}
+	return append(problems, kindProblems(cfg, msg)...)
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// listOptions controls the output of the list command.
+type listOptions struct {
+	format string
+	filter string
+	source bool
+	sortBy string
+	table  string // only this table, all of them when empty
+}
+
+// mapping is a single key to value mapping as shown by list.
+type mapping struct {
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+	Source string `json:"source,omitempty"`
+	// Table names the table of mappings other than commit kinds.
+	Table string `json:"table,omitempty"`
+	delim string // around the key in tokens, ':' when empty
+}
+
+// tableName returns the name of the table m is in.
+func tableName(m mapping) string {
+	if m.Table == "" {
+		return kindsTable
+	}
+	return m.Table
+}
+
+// token returns the key of m written as a token.
+func (m mapping) token() string {
+	d := m.delim
+	if d == "" {
+		d = ":"
+	}
+	return d + m.Key + d
+}
+
+// grouped reports whether mappings come from more than the commit kinds,
+// so the table of each needs to be shown.
+func grouped(mappings []mapping) bool {
+	for _, m := range mappings {
+		if m.Table != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// listFormats maps each --format to the function that writes it.
+var listFormats = map[string]func(io.Writer, []mapping, bool) error{
+	"text":     writeText,
+	"json":     writeJSON,
+	"yaml":     writeYAML,
+	"toml":     writeTOML,
+	"csv":      writeCSV,
+	"markdown": writeMarkdown,
+}
+
+// selectMappings filters and sorts the mappings in cfg, the commit kinds
+// first and then every other table in the order of their names. The filter
+// matches when the key or value contains it, or when it is a regular
+// expression that matches either, so it has to be a valid one.
+func selectMappings(cfg *Config, opts listOptions) ([]mapping, error) {
+	var re *regexp.Regexp
+	if opts.filter != "" {
+		var err error
+		if re, err = regexp.Compile(opts.filter); err != nil {
+			return nil, fmt.Errorf("invalid filter %q: %v", opts.filter, err)
+		}
+	}
+	matches := func(s string) bool {
+		return strings.Contains(s, opts.filter) || (re != nil && re.MatchString(s))
+	}
+	var less func(a, b mapping) bool
+	switch opts.sortBy {
+	case "", "key":
+		less = func(a, b mapping) bool { return a.Key < b.Key }
+	case "value":
+		less = func(a, b mapping) bool {
+			if a.Value != b.Value {
+				return a.Value < b.Value
+			}
+			return a.Key < b.Key
+		}
+	default:
+		return nil, fmt.Errorf("unknown sort %q, use key or value", opts.sortBy)
+	}
+	tables := append([]string{kindsTable}, cfg.tableNames()...)
+	if opts.table != "" {
+		if _, ok := cfg.Tables[opts.table]; !ok && opts.table != kindsTable {
+			return nil, fmt.Errorf("unknown table %q, use %s", opts.table, strings.Join(tables, ", "))
+		}
+		tables = []string{opts.table}
+	}
+
+	out := []mapping{}
+	for _, name := range tables {
+		words, table, delim := cfg.Words, "", ""
+		if name != kindsTable {
+			words, table, delim = cfg.Tables[name].Words, name, cfg.Tables[name].Delimiter
+		}
+		start := len(out)
+		for key, value := range words {
+			if opts.filter != "" && !matches(key) && !matches(value) {
+				continue
+			}
+			m := mapping{Key: key, Value: value, Table: table, delim: delim}
+			if opts.source && table == "" {
+				m.Source = cfg.Sources[key]
+			} else if opts.source {
+				m.Source = cfg.Sources[tableSourceKey(table, key)]
+			}
+			out = append(out, m)
+		}
+		group := out[start:]
+		sort.Slice(group, func(i, j int) bool { return less(group[i], group[j]) })
+	}
+	return out, nil
+}
+
+// listAvailable shows the mappings of dir, in alphabetical order unless
+// asked otherwise
+func listAvailable(dir string, opts listOptions) error {
+	cfg, err := loadEmojiMap(dir)
+	if err != nil {
+		return err
+	}
+	write, ok := listFormats[opts.format]
+	if !ok {
+		return usageErrorf("unknown format %q", opts.format)
+	}
+	mappings, err := selectMappings(cfg, opts)
+	if err != nil {
+		return usageErrorf("%v", err)
+	}
+	return write(os.Stdout, mappings, opts.source)
+}
+
+// writeText writes the padded table meant for people, surrounded by blank
+// lines.
+func writeText(w io.Writer, mappings []mapping, source bool) error {
+	// Get the longest key and value so the columns line up
+	var maxKey, maxValue int
+	for _, m := range mappings {
+		if len(m.Key) > maxKey {
+			maxKey = len(m.Key)
+		}
+		if len(m.Value) > maxValue {
+			maxValue = len(m.Value)
+		}
+	}
+	fmt.Fprintln(w)
+	for i, m := range mappings {
+		if grouped(mappings) && (i == 0 || m.Table != mappings[i-1].Table) {
+			if i > 0 {
+				fmt.Fprintln(w)
+			}
+			fmt.Fprintln(w, tableName(m))
+		}
+		displayKey := rightPad(m.token(), " ", (maxKey-len(m.Key))+2)
+		if source {
+			fmt.Fprintln(w, displayKey, rightPad(m.Value, " ", (maxValue-len(m.Value))+2), m.Source)
+		} else {
+			fmt.Fprintln(w, displayKey, m.Value)
+		}
+	}
+	fmt.Fprintln(w)
+	return nil
+}
+
+func writeJSON(w io.Writer, mappings []mapping, source bool) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	return enc.Encode(mappings)
+}
+
+// quoteString returns s as a double quoted JSON string, which is also a
+// valid YAML and TOML basic string.
+func quoteString(s string) string {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+func writeYAML(w io.Writer, mappings []mapping, source bool) error {
+	if len(mappings) == 0 {
+		_, err := fmt.Fprintln(w, "[]")
+		return err
+	}
+	for _, m := range mappings {
+		fmt.Fprintf(w, "- key: %s\n  value: %s\n", quoteString(m.Key), quoteString(m.Value))
+		if m.Table != "" {
+			fmt.Fprintf(w, "  table: %s\n", quoteString(m.Table))
+		}
+		if source {
+			fmt.Fprintf(w, "  source: %s\n", quoteString(m.Source))
+		}
+	}
+	return nil
+}
+
+// writeTOML writes a [commitKinds] table, and the delimiter and words of
+// every other table, that can be pasted into a .lipstickrc. Sources are
+// added as comments.
+func writeTOML(w io.Writer, mappings []mapping, source bool) error {
+	for i, m := range mappings {
+		if i == 0 || m.Table != mappings[i-1].Table {
+			if i > 0 {
+				fmt.Fprintln(w)
+			}
+			if m.Table == "" {
+				fmt.Fprintln(w, "[commitKinds]")
+			} else {
+				fmt.Fprintf(w, "[tables.%s]\ndelimiter = %s\n\n", quoteString(m.Table), quoteString(m.delim))
+				fmt.Fprintf(w, "[tables.%s.words]\n", quoteString(m.Table))
+			}
+		}
+		if source {
+			fmt.Fprintf(w, "%s = %s # %s\n", quoteString(m.Key), quoteString(m.Value), m.Source)
+		} else {
+			fmt.Fprintf(w, "%s = %s\n", quoteString(m.Key), quoteString(m.Value))
+		}
+	}
+	return nil
+}
+
+func writeCSV(w io.Writer, mappings []mapping, source bool) error {
+	cw := csv.NewWriter(w)
+	header := []string{"key", "value"}
+	if source {
+		header = append(header, "source")
+	}
+	tables := grouped(mappings)
+	if tables {
+		header = append(header, "table")
+	}
+	cw.Write(header)
+	for _, m := range mappings {
+		row := []string{m.Key, m.Value}
+		if source {
+			row = append(row, m.Source)
+		}
+		if tables {
+			row = append(row, tableName(m))
+		}
+		cw.Write(row)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func writeMarkdown(w io.Writer, mappings []mapping, source bool) error {
+	cell := func(s string) string {
+		return strings.Replace(s, "|", `\|`, -1)
+	}
+	header := []string{"Key", "Value"}
+	if source {
+		header = append(header, "Source")
+	}
+	tables := grouped(mappings)
+	if tables {
+		header = append(header, "Table")
+	}
+	fmt.Fprintf(w, "| %s |\n|%s\n", strings.Join(header, " | "), strings.Repeat(" --- |", len(header)))
+	for _, m := range mappings {
+		row := []string{"`" + cell(m.token()) + "`", cell(m.Value)}
+		if source {
+			row = append(row, cell(m.Source))
+		}
+		if tables {
+			row = append(row, cell(tableName(m)))
+		}
+		fmt.Fprintf(w, "| %s |\n", strings.Join(row, " | "))
+	}
+	return nil
+}
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The language server speaks just enough of the protocol for commit message
+// buffers: full document sync, completion, hover, diagnostics and a code
+// action that applies the mappings. Positions are counted in UTF-16 code
+// units as the protocol requires.
+
+// emojiGlyphs turns the shortcodes used by the builtin config into the emoji
+// they stand for, for previews.
+var emojiGlyphs = map[string]string{
+	":ambulance:":        "🚑",
+	":art:":              "🎨",
+	":bookmark:":         "🔖",
+	":books:":            "📚",
+	":bug:":              "🐛",
+	":construction:":     "🚧",
+	":copyright:":        "©️",
+	":fire:":             "🔥",
+	":lipstick:":         "💄",
+	":lock:":             "🔒",
+	":mute:":             "🔇",
+	":racehorse:":        "🐎",
+	":snowflake:":        "❄️",
+	":sparkles:":         "✨",
+	":speaker:":          "🔈",
+	":tada:":             "🎉",
+	":white_check_mark:": "✅",
+}
+
+// preview returns value with the shortcodes it contains shown as emoji.
+func preview(value string) string {
+	return tokenPattern.ReplaceAllStringFunc(value, func(t string) string {
+		if g, ok := emojiGlyphs[t]; ok {
+			return g
+		}
+		return t
+	})
+}
+
+type rpcRequest struct {
+	ID     *json.RawMessage `json:"id"`
+	Method string           `json:"method"`
+	Params json.RawMessage  `json:"params"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type position struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start position `json:"start"`
+	End   position `json:"end"`
+}
+
+type textEdit struct {
+	Range   lspRange `json:"range"`
+	NewText string   `json:"newText"`
+}
+
+type markupContent struct {
+	Kind  string `json:"kind"`
+	Value string `json:"value"`
+}
+
+type completionItem struct {
+	Label         string         `json:"label"`
+	Kind          int            `json:"kind"`
+	Detail        string         `json:"detail"`
+	Documentation *markupContent `json:"documentation,omitempty"`
+	TextEdit      textEdit       `json:"textEdit"`
+}
+
+type hover struct {
+	Contents markupContent `json:"contents"`
+	Range    lspRange      `json:"range"`
+}
+
+type diagnostic struct {
+	Range    lspRange `json:"range"`
+	Severity int      `json:"severity"`
+	Source   string   `json:"source"`
+	Message  string   `json:"message"`
+}
+
+type codeAction struct {
+	Title string `json:"title"`
+	Kind  string `json:"kind"`
+	Edit  struct {
+		Changes map[string][]textEdit `json:"changes"`
+	} `json:"edit"`
+}
+
+type documentPosition struct {
+	TextDocument struct {
+		URI string `json:"uri"`
+	} `json:"textDocument"`
+	Position position `json:"position"`
+}
+
+const (
+	completionKindValue = 12
+	severityWarning     = 2
+)
+
+// errExitWithoutShutdown is returned when the client exits without asking
+// the server to shut down first, which the protocol treats as a failure.
+var errExitWithoutShutdown = errors.New("exit received before shutdown")
+
+// lspServer holds the open documents of one client. mu guards the
+// documents and the output, which config reloads use from the watcher.
+type lspServer struct {
+	mu       sync.Mutex
+	configs  *configManager
+	events   <-chan configEvent
+	stop     chan struct{}
+	docs     map[string]string
+	out      io.Writer
+	shutdown bool
+}
+
+// serveLSP runs a language server reading requests from in and writing
+// responses and notifications to out until the client exits.
+func serveLSP(in io.Reader, out io.Writer) error {
+	s := &lspServer{docs: map[string]string{}, out: out}
+	defer s.close()
+	r := textproto.NewReader(bufio.NewReader(in))
+	for {
+		header, err := r.ReadMIMEHeader()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		n, err := strconv.Atoi(header.Get("Content-Length"))
+		if err != nil {
+			return fmt.Errorf("bad Content-Length: %v", err)
+		}
+		body := make([]byte, n)
+		if _, err := io.ReadFull(r.R, body); err != nil {
+			return err
+		}
+		var req rpcRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			return err
+		}
+		if req.Method == "exit" {
+			if !s.shutdown {
+				return errExitWithoutShutdown
+			}
+			return nil
+		}
+		s.mu.Lock()
+		result, rerr := s.handle(req)
+		if req.ID == nil {
+			s.mu.Unlock()
+			continue
+		}
+		resp := map[string]interface{}{"jsonrpc": "2.0", "id": req.ID}
+		if rerr != nil {
+			resp["error"] = rerr
+		} else {
+			resp["result"] = result
+		}
+		err = s.send(resp)
+		s.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// close stops watching the config.
+func (s *lspServer) close() {
+	if s.configs != nil {
+		close(s.stop)
+		s.configs.Unsubscribe(s.events)
+	}
+}
+
+// reloaded refreshes the diagnostics of every open document when the config
+// changes and tells the user when it could not be reloaded.
+func (s *lspServer) reloaded() {
+	for ev := range s.events {
+		s.mu.Lock()
+		if ev.Err != nil {
+			s.notify("window/showMessage", map[string]interface{}{
+				"type":    1,
+				"message": "lipstick: could not reload config, keeping the previous one: " + ev.Err.Error(),
+			})
+		} else {
+			for uri, text := range s.docs {
+				s.update(uri, text)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *lspServer) config() *Config {
+	return s.configs.Config()
+}
+
+func (s *lspServer) send(msg interface{}) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(s.out, "Content-Length: %d\r\n\r\n%s", len(data), data)
+	return err
+}
+
+func (s *lspServer) notify(method string, params interface{}) error {
+	return s.send(map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params})
+}
+
+// handle dispatches a single request or notification.
+func (s *lspServer) handle(req rpcRequest) (interface{}, *rpcError) {
+	if s.configs == nil && req.Method != "initialize" {
+		if req.ID == nil {
+			return nil, nil
+		}
+		return nil, &rpcError{Code: -32002, Message: "server not initialized"}
+	}
+	switch req.Method {
+	case "initialize":
+		return s.initialize(req.Params)
+	case "shutdown":
+		s.shutdown = true
+		return nil, nil
+	case "textDocument/didOpen":
+		var p struct {
+			TextDocument struct {
+				URI  string `json:"uri"`
+				Text string `json:"text"`
+			} `json:"textDocument"`
+		}
+		json.Unmarshal(req.Params, &p)
+		s.update(p.TextDocument.URI, p.TextDocument.Text)
+	case "textDocument/didChange":
+		var p struct {
+			TextDocument struct {
+				URI string `json:"uri"`
+			} `json:"textDocument"`
+			ContentChanges []struct {
+				Text string `json:"text"`
+			} `json:"contentChanges"`
+		}
+		json.Unmarshal(req.Params, &p)
+		if n := len(p.ContentChanges); n > 0 {
+			s.update(p.TextDocument.URI, p.ContentChanges[n-1].Text)
+		}
+	case "textDocument/didClose":
+		var p documentPosition
+		json.Unmarshal(req.Params, &p)
+		delete(s.docs, p.TextDocument.URI)
+		s.notify("textDocument/publishDiagnostics", map[string]interface{}{
+			"uri": p.TextDocument.URI, "diagnostics": []diagnostic{},
+		})
+	case "textDocument/completion":
+		var p documentPosition
+		json.Unmarshal(req.Params, &p)
+		return s.complete(p), nil
+	case "textDocument/hover":
+		var p documentPosition
+		json.Unmarshal(req.Params, &p)
+		return s.hover(p), nil
+	case "textDocument/codeAction":
+		var p documentPosition
+		json.Unmarshal(req.Params, &p)
+		return s.codeActions(p.TextDocument.URI), nil
+	default:
+		if req.ID != nil {
+			return nil, &rpcError{Code: -32601, Message: "method not found: " + req.Method}
+		}
+	}
+	return nil, nil
+}
+
+// initialize loads the config of the workspace the client opened, falling
+// back on the directory lipstick was started in, and starts watching it.
+func (s *lspServer) initialize(params json.RawMessage) (interface{}, *rpcError) {
+	var p struct {
+		RootURI string `json:"rootUri"`
+	}
+	json.Unmarshal(params, &p)
+	dir := pwd
+	if root := uriToPath(p.RootURI); root != "" && isDir(root) {
+		dir = root
+	}
+	configs, err := newConfigManager(dir)
+	if err != nil {
+		return nil, &rpcError{Code: -32603, Message: "could not load config: " + err.Error()}
+	}
+	s.configs, s.events, s.stop = configs, configs.Subscribe(), make(chan struct{})
+	go configs.Watch(time.Second, s.stop)
+	go s.reloaded()
+	return map[string]interface{}{
+		"capabilities": map[string]interface{}{
+			"textDocumentSync":   1,
+			"completionProvider": map[string]interface{}{"triggerCharacters": []string{":"}},
+			"hoverProvider":      true,
+			"codeActionProvider": true,
+		},
+		"serverInfo": map[string]string{"name": "lipstick", "version": Version},
+	}, nil
+}
+
+func uriToPath(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return ""
+	}
+	return u.Path
+}
+
+// update stores the new text of a document and publishes its diagnostics.
+func (s *lspServer) update(uri, text string) {
+	s.docs[uri] = text
+	lines := strings.Split(text, "\n")
+	diags := []diagnostic{}
+	for _, p := range lintMessage(s.config(), text) {
+		line := lines[p.Line]
+		diags = append(diags, diagnostic{
+			Range: lspRange{
+				Start: position{p.Line, utf16Len(line[:p.Start])},
+				End:   position{p.Line, utf16Len(line[:p.End])},
+			},
+			Severity: severityWarning,
+			Source:   "lipstick",
+			Message:  p.Message,
+		})
+	}
+	s.notify("textDocument/publishDiagnostics", map[string]interface{}{"uri": uri, "diagnostics": diags})
+}
+
+// lineAt returns the line of a document a position is on and the byte
+// offset of the position in it.
+func (s *lspServer) lineAt(p documentPosition) (string, int, bool) {
+	lines := strings.Split(s.docs[p.TextDocument.URI], "\n")
+	if p.Position.Line < 0 || p.Position.Line >= len(lines) {
+		return "", 0, false
+	}
+	line := lines[p.Position.Line]
+	return line, byteOffset(line, p.Position.Character), true
+}
+
+// complete offers the tokens matching the one being typed at the cursor.
+func (s *lspServer) complete(p documentPosition) []completionItem {
+	items := []completionItem{}
+	line, cur, ok := s.lineAt(p)
+	if !ok {
+		return items
+	}
+	cfg := s.config()
+	i := partialToken(map[byte]*Config{':': cfg}, line[:cur])
+	if i < 0 {
+		return items
+	}
+	start := position{p.Position.Line, utf16Len(line[:i])}
+	for _, token := range completeKeys(cfg, line[i:cur]) {
+		key := token[1 : len(token)-1]
+		items = append(items, completionItem{
+			Label:         token,
+			Kind:          completionKindValue,
+			Detail:        s.describe(key),
+			Documentation: &markupContent{Kind: "markdown", Value: s.hoverText(key)},
+			TextEdit:      textEdit{Range: lspRange{start, p.Position}, NewText: token},
+		})
+	}
+	return items
+}
+
+// hover shows the mapping of the token under the cursor.
+func (s *lspServer) hover(p documentPosition) interface{} {
+	line, cur, ok := s.lineAt(p)
+	if !ok {
+		return nil
+	}
+	for _, loc := range tokenPattern.FindAllStringIndex(line, -1) {
+		if cur < loc[0] || cur >= loc[1] {
+			continue
+		}
+		key, ok := s.config().lookup(line[loc[0]+1 : loc[1]-1])
+		if !ok {
+			return nil
+		}
+		return hover{
+			Contents: markupContent{Kind: "markdown", Value: s.hoverText(key)},
+			Range: lspRange{
+				Start: position{p.Position.Line, utf16Len(line[:loc[0]])},
+				End:   position{p.Position.Line, utf16Len(line[:loc[1]])},
+			},
+		}
+	}
+	return nil
+}
+
+func (s *lspServer) describe(key string) string {
+	value := s.config().Words[key]
+	if p := preview(value); p != value {
+		return p + " " + value
+	}
+	return value
+}
+
+func (s *lspServer) hoverText(key string) string {
+	return fmt.Sprintf("`:%s:` → %s\n\nfrom %s", key, s.describe(key), s.config().Sources[key])
+}
+
+// codeActions offers to apply the mappings to the whole document when that
+// would change it.
+func (s *lspServer) codeActions(uri string) []codeAction {
+	actions := []codeAction{}
+	text, ok := s.docs[uri]
+	if !ok {
+		return actions
+	}
+	out := replace(s.config(), text)
+	if out == text {
+		return actions
+	}
+	lines := strings.Split(text, "\n")
+	last := len(lines) - 1
+	a := codeAction{Title: "Apply lipstick mappings", Kind: "quickfix"}
+	a.Edit.Changes = map[string][]textEdit{uri: {{
+		Range:   lspRange{position{0, 0}, position{last, utf16Len(lines[last])}},
+		NewText: out,
+	}}}
+	return append(actions, a)
+}
+
+// utf16Len returns the length of s in UTF-16 code units.
+func utf16Len(s string) int {
+	n := 0
+	for _, r := range s {
+		if r >= 0x10000 {
+			n += 2
+		} else {
+			n++
+		}
+	}
+	return n
+}
+
+// byteOffset converts a UTF-16 column on line to a byte offset.
+func byteOffset(line string, col int) int {
+	n := 0
+	for i, r := range line {
+		if n >= col {
+			return i
+		}
+		if r >= 0x10000 {
+			n += 2
+		} else {
+			n++
+		}
+	}
+	return len(line)
+}
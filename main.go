@@ -2,102 +2,168 @@ package main
 
 import (
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"sort"
 	"strings"
 
 	"github.com/BurntSushi/toml"
 	"github.com/codegangsta/cli"
-	"github.com/natefinch/atomic"
-	"github.com/pborman/getopt"
 )
 
 var Version = "No Version Provided"
 
 // Config holds the emoji configuration
 type Config struct {
-	Words map[string]string `toml:"commitKinds"`
+	// Extends lists configs merged in before this one, as file paths or
+	// git:<rev>:<path>.
+	Extends []string          `toml:"extends" json:"extends" yaml:"extends"`
+	Words   map[string]string `toml:"commitKinds" json:"commitKinds" yaml:"commitKinds"`
+	Output  Output            `toml:"output" json:"output" yaml:"output"`
+	// Paths maps path globs to the kinds allowed for changes to them, the
+	// first being the one suggested.
+	Paths map[string][]string `toml:"paths" json:"paths" yaml:"paths"`
+	// Kinds holds the templates and required sections of commit kinds.
+	Kinds map[string]KindRules `toml:"kinds" json:"kinds" yaml:"kinds"`
+	// Tables holds the mapping tables other than commitKinds by name.
+	Tables map[string]Table `toml:"tables" json:"tables" yaml:"tables"`
+	// Policy decides how tokens are matched to keys.
+	Policy Policy `toml:"policy" json:"policy" yaml:"policy"`
+
+	// Dir is the directory the config was loaded for. Lookups in the
+	// repository, such as the staged files, are made from it.
+	Dir string `toml:"-" json:"-" yaml:"-"`
+	// Sources records which config file each mapping came from.
+	Sources map[string]string `toml:"-" json:"-" yaml:"-"`
+	// Files lists the config files that were read, in the order they were
+	// applied.
+	Files []string `toml:"-" json:"-" yaml:"-"`
+
+	// keys maps normalized keys to the keys in Words, see lookup.
+	keys map[string]string
+}
+
+// builtinSource is the source reported for the built in mappings.
+const builtinSource = "builtin"
+
+// setSource marks every mapping in cfg as coming from src.
+func (cfg *Config) setSource(src string) {
+	cfg.Files = []string{src}
+	cfg.Sources = map[string]string{}
+	for key := range cfg.Words {
+		cfg.Sources[key] = src
+	}
+	for name, t := range cfg.Tables {
+		for key := range t.Words {
+			cfg.Sources[tableSourceKey(name, key)] = src
+		}
+	}
 }
 
+// pwd is the directory lipstick was started in. Commands are given the
+// directory they work in, which is pwd outside of tests.
 var pwd string
-var hook = "\n# simplifies emoji usage \nlipstick \"`cat $1`\" > \"$1\""
+
+// hook is the body of the commit-msg hook. The message file is replaced
+// atomically, so a failing lipstick never truncates it.
+var hook = "# simplifies emoji usage\nlipstick commit-msg \"$1\"\n"
+
+// noteHook is the body of the post-commit hook used in notes mode.
+var noteHook = "# records lipstick notes\nlipstick note\n"
 
 func init() {
 	var err error
 	pwd, err = os.Getwd()
 	if err != nil {
-		log.Fatal(err)
+		os.Exit(report(ioError(err)))
 	}
 }
 
-// install adds the hook to this program to the local git repo
-func install() {
-	if _, err := os.Stat(pwd + "/.git"); err != nil {
-		log.Fatal("fatal: Not a git repository (or any of the parent directories): .git")
+// install adds the hook to this program to every repository found in dir.
+func install(dir string) error {
+	backends, err := detectVCS(dir)
+	if err != nil {
+		return err
 	}
-	f, err := os.OpenFile(pwd+"/.git/hooks/commit-msg", os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0777)
-	defer f.Close()
-	_, werr := f.WriteString(hook)
-	if werr != nil || err != nil {
-		log.Fatal("fatal: unable to create the commit-msg hook!", werr, err)
+	cfg, err := loadEmojiMap(dir)
+	if err != nil {
+		return err
+	}
+	for _, b := range backends {
+		if err := b.install(cfg); err != nil {
+			return err
+		}
+		log.Println("created", b.name(), "hook for", dir)
 	}
-	log.Println("created hook for ", pwd)
+	return nil
 }
 
-func uninstall() {
-	if _, err := os.Stat(pwd + "/.git"); err != nil {
-		log.Fatal("fatal: Not a git repository (or any of the parent directories): .git")
-	}
-	f, err := os.Open(pwd + "/.git/hooks/commit-msg")
-	d, rerr := ioutil.ReadAll(f)
-	if err != nil || rerr != nil {
-		log.Fatal("fatal: unable to remove commit-msg hook", rerr, err)
+func uninstall(dir string) error {
+	backends, err := detectVCS(dir)
+	if err != nil {
+		return err
 	}
-	f.Close()
-	old := string(d)
-	new := strings.Replace(old, "\n# simplifies emoji usage", "", -1)
-	new = strings.Replace(new, "\nlipstick \"`cat $1`\" > \"$1\"", "", -1)
-	out := strings.NewReader(new)
-	if err := atomic.WriteFile(pwd+"/.git/hooks/commit-msg", out); err != nil {
-		log.Fatal("fatal: unable to remove commit-msg hook", err)
+	for _, b := range backends {
+		if err := b.uninstall(); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
-// Run is our main function
-func Run(c *cli.Context) {
-	getopt.Parse()
-	args := getopt.Args()
-	msg := strings.Join(args, " ")
-	cfg, err := loadEmojiMap()
+// status shows whether lipstick is hooked into each repository found in
+// dir.
+func status(dir string, w io.Writer) error {
+	if global := globalStatus(); global != "" {
+		fmt.Fprintln(w, global)
+	}
+	backends, err := detectVCS(dir)
 	if err != nil {
-		log.Fatal("fatal: could not load config", err)
+		return err
 	}
-	if msg != "" {
-		fmt.Println(replace(cfg, msg))
-	} else {
-		log.Fatal("fatal: no message given")
+	for _, b := range backends {
+		ok, path, err := b.status()
+		if err != nil {
+			return err
+		}
+		state := "not installed"
+		if ok {
+			state = "installed"
+		}
+		fmt.Fprintf(w, "%s: %s (%s)\n", b.name(), state, path)
 	}
+	return nil
 }
 
-// loadEmojiMap loads the config file into our config and fallsback on the
-// default built in config
-func loadEmojiMap() (*Config, error) {
-	cfg := &Config{}
-	if _, err := loadLocalConfig(cfg); err != nil {
-		if _, err := loadDefaultConfig(cfg); err != nil {
-			return nil, err
-		}
+// Run processes the message given as arguments, joined with spaces, as
+// hooks installed by older versions do. New code should use replace.
+func Run(c *cli.Context) error {
+	msg := strings.Join(c.Args(), " ")
+	if msg == "" {
+		return usageErrorf("no message given, see lipstick replace --help")
 	}
-	return cfg, nil
+	cfg, err := loadEmojiMap(pwd)
+	if err != nil {
+		return err
+	}
+	out, err := processMessage(cfg, msg)
+	if err != nil {
+		return err
+	}
+	fmt.Println(out)
+	return nil
 }
 
-// loadLocalConfig attempts to load the local config file
-func loadLocalConfig(cfg *Config) (*Config, error) {
-	if _, err := toml.DecodeFile(pwd+"/.lipstickrc", &cfg); err != nil {
-		return nil, err
+// loadEmojiMap loads the config files in dir and falls back on the builtin
+// config when there are none.
+func loadEmojiMap(dir string) (*Config, error) {
+	cfg, err := loadConfig(dir)
+	if err != nil {
+		return nil, configError(err)
 	}
+	debugf("config read from %s", strings.Join(cfg.Files, ", "))
 	return cfg, nil
 }
 
@@ -111,66 +177,59 @@ func loadDefaultConfig(cfg *Config) (*Config, error) {
 	if _, err := toml.Decode(string(data), &cfg); err != nil {
 		return nil, err
 	}
+	cfg.setSource(builtinSource)
 	return cfg, nil
 }
 
 // replace finds words that fit our params in the msg and replaces them with
-// the words defined in our config file.
+// the words defined in our config file, commit kinds first and then the
+// other tables.
 func replace(cfg *Config, msg string) string {
-	for key, value := range cfg.Words {
-		msg = strings.Replace(msg, ":"+key+":", value, -1)
-	}
-	return msg
+	var b strings.Builder
+	w := newReplacer(cfg, &b)
+	io.WriteString(w, msg)
+	w.Flush()
+	return b.String()
 }
 
-// createConfig writes the default .lipstickrc to a file.
-func createConfig() {
-	if _, err := os.Stat(".lipstickrc"); !os.IsNotExist(err) {
-		log.Fatal("fatal: .lipstickrc exists")
-	}
-	data, err := Asset("config/lipstickrc.toml")
-	if err != nil {
-		log.Fatal("fatal: could not load default .lipstickrc", err)
+// reverse turns mapped values in msg back into their :key: tokens. Longer
+// values win over values they contain and, when several keys share a value,
+// the first key in alphabetical order is used.
+func reverse(cfg *Config, msg string) string {
+	keys := make([]string, 0, len(cfg.Words))
+	for key := range cfg.Words {
+		keys = append(keys, key)
 	}
-	r := strings.NewReader(string(data))
-	if err := atomic.WriteFile(".lipstickrc", r); err != nil {
-		log.Fatal("fatal: could not generate .lipstickrc", err)
+	sort.Slice(keys, func(i, j int) bool {
+		vi, vj := cfg.Words[keys[i]], cfg.Words[keys[j]]
+		if len(vi) != len(vj) {
+			return len(vi) > len(vj)
+		}
+		return keys[i] < keys[j]
+	})
+	var pairs []string
+	for _, key := range keys {
+		if cfg.Words[key] != "" {
+			pairs = append(pairs, cfg.Words[key], ":"+key+":")
+		}
 	}
+	return strings.NewReplacer(pairs...).Replace(msg)
 }
 
-// listAvailable shows the available mappings in alphabetical order
-func listAvailable() {
-	cfg, err := loadEmojiMap()
+// createConfig writes the default .lipstickrc to dir.
+func createConfig(dir string) error {
+	path := filepath.Join(dir, ".lipstickrc")
+	if _, err := readFile(path); !os.IsNotExist(err) {
+		return usageErrorf(".lipstickrc exists")
+	}
+	data, err := Asset("config/lipstickrc.toml")
 	if err != nil {
-		log.Fatal("fatal: could not load config", err)
+		return err
 	}
-	fmt.Println()
-
-	// Get the longest keys maxLength and create a slice of keys
-	var maxLen int
-	keys := []string{}
-	for key := range cfg.Words {
-		keys = append(keys, key)
-		if len(key) > maxLen {
-			maxLen = len(key)
-		}
+	if err := writeFile(path, string(data)); err != nil {
+		return ioError(fmt.Errorf("could not generate .lipstickrc: %v", err))
 	}
-
-	// Sort keys by alpha
-	sort.Strings(keys)
-
-	var padVal int
-	var displayKey string
-	var value string
-	for _, key := range keys {
-		// Sets the padding value based on the length of the key
-		padVal = (maxLen - len(key)) + 2
-
-		displayKey = rightPad(":"+key+":", " ", padVal)
-		value = cfg.Words[key]
-		fmt.Println(displayKey, value)
-	}
-	fmt.Println()
+	return nil
 }
 
 func rightPad(s string, padStr string, pLen int) string {
@@ -181,38 +240,249 @@ func main() {
 	app := cli.NewApp()
 	app.Name = "lipstick"
 	app.Usage = "Make your git commits more expressive"
-	app.Action = Run
+	app.Action = run(Run)
 	app.Version = Version
+	app.Flags = []cli.Flag{
+		cli.BoolFlag{
+			Name:   "quiet, q",
+			Usage:  "only print errors",
+			EnvVar: "LIPSTICK_QUIET",
+		},
+		cli.BoolFlag{
+			Name:   "verbose",
+			Usage:  "also print what lipstick is doing, with timestamps",
+			EnvVar: "LIPSTICK_VERBOSE",
+		},
+		cli.BoolFlag{
+			Name:   "json",
+			Usage:  "print errors as JSON objects",
+			EnvVar: "LIPSTICK_JSON",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run, n",
+			Usage: "print a diff of the files that would change instead of changing them",
+		},
+	}
+	app.Before = applyGlobalFlags
 	app.Commands = []cli.Command{
 		{
 			Name:    "install",
 			Aliases: []string{"i"},
-			Usage:   "initialize the git hook",
-			Action: func(c *cli.Context) {
-				install()
+			Usage:   "initialize the git, mercurial or jujutsu hook",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "global, g",
+					Usage: "install the hook for every git repository through core.hooksPath",
+				},
+				cli.BoolFlag{
+					Name:  "template",
+					Usage: "with --global, use init.templateDir so only new repositories get the hook",
+				},
 			},
+			Action: run(func(c *cli.Context) error {
+				if c.Bool("global") {
+					return installGlobal(c.Bool("template"))
+				}
+				return install(pwd)
+			}),
 		}, {
 			Name:    "uninstall",
 			Aliases: []string{"u"},
-			Usage:   "remove the git hook",
-			Action: func(c *cli.Context) {
-				uninstall()
+			Usage:   "remove the git, mercurial or jujutsu hook",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "global, g",
+					Usage: "remove the hook installed with install --global",
+				},
 			},
+			Action: run(func(c *cli.Context) error {
+				if c.Bool("global") {
+					return uninstallGlobal()
+				}
+				return uninstall(pwd)
+			}),
+		}, {
+			Name:    "status",
+			Aliases: []string{"s"},
+			Usage:   "shows whether the hook is installed",
+			Action: run(func(c *cli.Context) error {
+				return status(pwd, os.Stdout)
+			}),
 		}, {
 			Name:    "initialize",
 			Aliases: []string{"init"},
 			Usage:   "creates a .lipstickrc file if one does not exist",
-			Action: func(c *cli.Context) {
-				createConfig()
-			},
+			Action: run(func(c *cli.Context) error {
+				return createConfig(pwd)
+			}),
 		}, {
 			Name:    "list",
 			Aliases: []string{"l"},
 			Usage:   "lists the available lipstick mappings",
-			Action: func(c *cli.Context) {
-				listAvailable()
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "format",
+					Value: "text",
+					Usage: "output format: text, json, yaml, toml, csv or markdown",
+				},
+				cli.StringFlag{
+					Name:  "filter",
+					Usage: "only show mappings whose key or value contains or matches this",
+				},
+				cli.BoolFlag{
+					Name:  "source",
+					Usage: "show the config file each mapping came from",
+				},
+				cli.StringFlag{
+					Name:  "sort",
+					Value: "key",
+					Usage: "sort by key or value",
+				},
+				cli.StringFlag{
+					Name:  "table",
+					Usage: "only show the mappings of this table, commitKinds for the kinds",
+				},
 			},
+			Action: run(func(c *cli.Context) error {
+				return listAvailable(pwd, listOptions{
+					format: c.String("format"),
+					filter: c.String("filter"),
+					source: c.Bool("source"),
+					sortBy: c.String("sort"),
+					table:  c.String("table"),
+				})
+			}),
+		}, {
+			Name:  "replace",
+			Usage: "applies the mappings to [file...], or stdin for - or no files",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "in-place, i",
+					Usage: "write the results back to the files instead of stdout",
+				},
+			},
+			Action: run(func(c *cli.Context) error {
+				return runReplace(pwd, c.Args(), c.Bool("in-place"), os.Stdin, os.Stdout)
+			}),
+		}, {
+			Name:  "rewrite",
+			Usage: "apply the mappings to the commit messages in <range>",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "dry-run, n",
+					Usage: "show the message changes without rewriting anything",
+				},
+				cli.BoolFlag{
+					Name:  "force, f",
+					Usage: "overwrite an existing backup ref",
+				},
+			},
+			Action: run(func(c *cli.Context) error {
+				return rewriteHistory(pwd, strings.Join(c.Args(), " "), c.Bool("dry-run") || dryRun != nil, c.Bool("force"))
+			}),
+		}, {
+			Name:  "stats",
+			Usage: "counts the kinds of the commits in [range], HEAD by default",
+			Action: run(func(c *cli.Context) error {
+				return showStats(pwd, strings.Join(c.Args(), " "))
+			}),
+		}, {
+			Name:  "note",
+			Usage: "attaches the kinds of the last commit as a note (used by the post-commit hook)",
+			Action: run(func(c *cli.Context) error {
+				if err := attachPendingNote(pwd); err != nil {
+					return fmt.Errorf("unable to add note: %w", err)
+				}
+				return nil
+			}),
+		}, {
+			Name:  "hg-hook",
+			Usage: "applies the mappings to the last mercurial commit (used by the hgrc hook)",
+			Action: run(func(c *cli.Context) error {
+				return hgHook(pwd)
+			}),
+		}, {
+			Name:  "jj-editor",
+			Usage: "opens $EDITOR then applies the mappings (used as jj's ui.editor)",
+			Action: run(func(c *cli.Context) error {
+				return jjEditor(pwd, c.Args().First())
+			}),
+		}, {
+			Name:  "commit-msg",
+			Usage: "applies the mappings and rules to a message file (used by the commit-msg hook)",
+			Action: run(func(c *cli.Context) error {
+				return commitMsg(pwd, c.Args().First())
+			}),
+		}, {
+			Name:  "prepare-commit-msg",
+			Usage: "adds the template of the chosen kind (used by the prepare-commit-msg hook)",
+			Action: run(func(c *cli.Context) error {
+				return prepareCommitMsg(pwd, c.Args())
+			}),
+		}, {
+			Name:  "config",
+			Usage: "inspects the config",
+			Subcommands: []cli.Command{
+				{
+					Name:  "show",
+					Usage: "prints the effective config and the files it was read from",
+					Action: run(func(c *cli.Context) error {
+						return showConfig(pwd, os.Stdout)
+					}),
+				}, {
+					Name:  "check",
+					Usage: "reports keys that match the same tokens under the match policy",
+					Action: run(func(c *cli.Context) error {
+						return checkConfig(pwd, os.Stdout)
+					}),
+				},
+			},
+		}, {
+			Name:  "lsp",
+			Usage: "runs a language server on stdin and stdout for commit message editors",
+			Action: run(func(c *cli.Context) error {
+				return serveLSP(os.Stdin, os.Stdout)
+			}),
+		}, {
+			Name:        "serve",
+			Usage:       "serves the mappings, replace, reverse and lint as a JSON API",
+			Description: serveDescription,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "addr",
+					Value: "localhost:8080",
+					Usage: "address to listen on",
+				},
+				cli.StringFlag{
+					Name:  "repo",
+					Usage: "repository to load the config from, the current directory by default",
+				},
+			},
+			Action: run(func(c *cli.Context) error {
+				return serve(c.String("addr"), c.String("repo"))
+			}),
+		}, {
+			Name:  "completion",
+			Usage: "prints the completion script for bash, zsh or fish",
+			Action: run(func(c *cli.Context) error {
+				return writeCompletion(c.App, c.Args().First())
+			}),
+		}, {
+			Name:  "complete-keys",
+			Usage: "lists the :key: tokens completing [word] (used by the completion scripts)",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "describe",
+					Usage: "add the value after a tab",
+				},
+			},
+			Action: run(func(c *cli.Context) error {
+				return printKeyCompletions(pwd, c.Args().First(), c.Bool("describe"))
+			}),
 		},
 	}
-	app.Run(os.Args)
+	if err := app.Run(os.Args); err != nil {
+		// The cli package has already shown the usage for bad flags.
+		os.Exit(report(&cliError{exitUsage, err}))
+	}
 }
@@ -1,9 +1,23 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/BurntSushi/toml"
+	"github.com/jesusrmoreno/lipstick/internal/git"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -11,7 +25,7 @@ var cfg *Config
 
 func init() {
 	var err error
-	cfg, err = loadEmojiMap()
+	cfg, err = loadEmojiMap(pwd)
 	if err != nil {
 		log.Fatal("fatal: could not load map")
 	}
@@ -52,3 +66,1322 @@ func TestReplace(t *testing.T) {
 		})
 	})
 }
+
+func TestUnifiedDiff(t *testing.T) {
+	Convey("Given two identical messages", t, func() {
+		So(unifiedDiff("a", "b", "same\n", "same\n"), ShouldEqual, "")
+	})
+
+	Convey("Given a message with a changed subject", t, func() {
+		out := unifiedDiff("a", "b", ":docs: readme\n\nbody\n", ":books: readme\n\nbody\n")
+		Convey("Only the subject should be marked as changed", func() {
+			So(out, ShouldEqual, "--- a\n+++ b\n@@ -1,3 +1,3 @@\n-:docs: readme\n+:books: readme\n \n body\n")
+		})
+	})
+}
+
+func TestAnnotate(t *testing.T) {
+	Convey("Given a config in trailer mode", t, func() {
+		c := &Config{Words: cfg.Words, Output: Output{Mode: modeTrailer}}
+
+		Convey("The token should become a trailer", func() {
+			out, kinds := annotate(c, ":bugfix: fix the thing\n")
+			So(kinds, ShouldBeEmpty)
+			So(out, ShouldEqual, "fix the thing\n\nKind: bugfix\n")
+		})
+
+		Convey("An existing trailer block should be extended", func() {
+			out, _ := annotate(c, "fix it :bugfix:\n\nSigned-off-by: me <me@example.com>")
+			So(out, ShouldEqual, "fix it\n\nSigned-off-by: me <me@example.com>\nKind: bugfix")
+		})
+
+		Convey("Running it again should not add another trailer", func() {
+			once, _ := annotate(c, ":docs: readme")
+			twice, _ := annotate(c, once)
+			So(twice, ShouldEqual, once)
+		})
+	})
+
+	Convey("Given a config in notes mode", t, func() {
+		c := &Config{Words: cfg.Words, Output: Output{Mode: modeNotes}}
+		out, kinds := annotate(c, "docs :docs: and :tests: :unknown:")
+		So(out, ShouldEqual, "docs and :unknown:")
+		So(kinds, ShouldResemble, []string{"docs", "tests"})
+		So(formatNote(c, kinds), ShouldEqual, "Kind: docs\nKind: tests\n")
+	})
+}
+
+func TestVCSHooks(t *testing.T) {
+	Convey("Given mercurial and jujutsu repositories with existing config", t, func() {
+		dir, err := ioutil.TempDir("", "lipstick-vcs")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		os.MkdirAll(filepath.Join(dir, ".hg"), 0755)
+		os.MkdirAll(filepath.Join(dir, ".jj", "repo"), 0755)
+		hgrc := "[ui]\nusername = me\n"
+		jjrc := "[ui]\npager = \"less\"\n\n[user]\nname = \"me\"\n"
+		ioutil.WriteFile(filepath.Join(dir, ".hg", "hgrc"), []byte(hgrc), 0644)
+		ioutil.WriteFile(filepath.Join(dir, ".jj", "repo", "config.toml"), []byte(jjrc), 0644)
+
+		backends, err := detectVCS(dir)
+		So(err, ShouldBeNil)
+		So(len(backends), ShouldEqual, 2)
+
+		Convey("Installing and uninstalling should restore the config exactly", func() {
+			for _, b := range backends {
+				So(b.install(cfg), ShouldBeNil)
+				ok, _, err := b.status()
+				So(err, ShouldBeNil)
+				So(ok, ShouldBeTrue)
+				So(b.uninstall(), ShouldBeNil)
+				ok, _, _ = b.status()
+				So(ok, ShouldBeFalse)
+			}
+			d, _ := ioutil.ReadFile(filepath.Join(dir, ".hg", "hgrc"))
+			So(string(d), ShouldEqual, hgrc)
+			d, _ = ioutil.ReadFile(filepath.Join(dir, ".jj", "repo", "config.toml"))
+			So(string(d), ShouldEqual, jjrc)
+		})
+	})
+
+	Convey("Given a directory that is not a repository", t, func() {
+		dir, _ := ioutil.TempDir("", "lipstick-vcs")
+		defer os.RemoveAll(dir)
+		_, err := detectVCS(dir)
+		So(err, ShouldEqual, errNoRepository)
+	})
+}
+
+func TestHookChaining(t *testing.T) {
+	Convey("Given a hooks directory with an existing commit-msg hook", t, func() {
+		dir, err := ioutil.TempDir("", "lipstick-hooks")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		original := "#!/bin/sh\nexec commitlint --edit \"$1\"\n"
+		path := filepath.Join(dir, "commit-msg")
+		So(ioutil.WriteFile(path, []byte(original), 0750), ShouldBeNil)
+		g := gitVCS{hooksDir: dir}
+
+		Convey("Installing should move it behind the dispatcher", func() {
+			So(g.install(cfg), ShouldBeNil)
+			So(isDispatcher(path), ShouldBeTrue)
+			d, err := ioutil.ReadFile(filepath.Join(dir, "commit-msg.d", "00-commit-msg"))
+			So(err, ShouldBeNil)
+			So(string(d), ShouldEqual, original)
+			ok, _, _ := g.status()
+			So(ok, ShouldBeTrue)
+
+			Convey("Installing twice should not move the dispatcher aside", func() {
+				So(g.install(cfg), ShouldBeNil)
+				entries, _ := ioutil.ReadDir(filepath.Join(dir, "commit-msg.d"))
+				So(len(entries), ShouldEqual, 2)
+			})
+
+			Convey("Uninstalling should restore the original exactly", func() {
+				So(g.uninstall(), ShouldBeNil)
+				d, err := ioutil.ReadFile(path)
+				So(err, ShouldBeNil)
+				So(string(d), ShouldEqual, original)
+				fi, _ := os.Stat(path)
+				So(fi.Mode().Perm(), ShouldEqual, os.FileMode(0750))
+				_, err = os.Stat(filepath.Join(dir, "commit-msg.d"))
+				So(os.IsNotExist(err), ShouldBeTrue)
+			})
+		})
+	})
+	Convey("Given a hooks directory with an existing prepare-commit-msg hook", t, func() {
+		dir, err := ioutil.TempDir("", "lipstick-hooks")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "prepare-commit-msg")
+		So(ioutil.WriteFile(path, []byte("#!/bin/sh\necho original >> \"$1\"\n"), 0755), ShouldBeNil)
+
+		Convey("The original hook should run before lipstick's entry", func() {
+			So(installChained(dir, "prepare-commit-msg", "echo lipstick >> \"$1\"\n"), ShouldBeNil)
+			names, err := readDirNames(path + ".d")
+			So(err, ShouldBeNil)
+			So(names, ShouldResemble, []string{"00-prepare-commit-msg", "50-lipstick"})
+
+			msg := filepath.Join(dir, "msg")
+			So(exec.Command(path, msg).Run(), ShouldBeNil)
+			d, _ := ioutil.ReadFile(msg)
+			So(string(d), ShouldEqual, "original\nlipstick\n")
+		})
+	})
+
+	Convey("Given a dispatcher installed without ordering prefixes", t, func() {
+		dir, err := ioutil.TempDir("", "lipstick-hooks")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		original := "#!/bin/sh\necho mine\n"
+		path := filepath.Join(dir, "commit-msg")
+		So(os.Mkdir(path+".d", 0755), ShouldBeNil)
+		So(ioutil.WriteFile(path, []byte(dispatcherScript("commit-msg")), 0755), ShouldBeNil)
+		So(ioutil.WriteFile(filepath.Join(path+".d", "commit-msg"), []byte(original), 0755), ShouldBeNil)
+		So(ioutil.WriteFile(filepath.Join(path+".d", "lipstick"), []byte("#!/bin/sh\n"+hook), 0755), ShouldBeNil)
+		g := gitVCS{hooksDir: dir}
+
+		Convey("It should still count as installed", func() {
+			ok, _, _ := g.status()
+			So(ok, ShouldBeTrue)
+		})
+
+		Convey("Installing should rename the entries", func() {
+			So(g.install(cfg), ShouldBeNil)
+			names, err := readDirNames(path + ".d")
+			So(err, ShouldBeNil)
+			So(names, ShouldResemble, []string{"00-commit-msg", "50-lipstick"})
+		})
+
+		Convey("Uninstalling should restore the original", func() {
+			So(g.uninstall(), ShouldBeNil)
+			d, err := ioutil.ReadFile(path)
+			So(err, ShouldBeNil)
+			So(string(d), ShouldEqual, original)
+			_, err = os.Stat(path + ".d")
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+	})
+}
+
+func TestDryRun(t *testing.T) {
+	Convey("Given a hooks directory with an existing commit-msg hook", t, func() {
+		dir, err := ioutil.TempDir("", "lipstick-hooks")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		original := "#!/bin/sh\necho mine\n"
+		path := filepath.Join(dir, "commit-msg")
+		So(ioutil.WriteFile(path, []byte(original), 0755), ShouldBeNil)
+		g := gitVCS{hooksDir: dir}
+		dryRun = map[string]*string{}
+		defer func() { dryRun = nil }()
+
+		Convey("Installing should plan the changes without writing them", func() {
+			So(g.install(cfg), ShouldBeNil)
+			d, _ := ioutil.ReadFile(path)
+			So(string(d), ShouldEqual, original)
+			_, err := os.Stat(filepath.Join(dir, "commit-msg.d"))
+			So(os.IsNotExist(err), ShouldBeTrue)
+
+			names, err := readDirNames(filepath.Join(dir, "commit-msg.d"))
+			So(err, ShouldBeNil)
+			So(names, ShouldResemble, []string{"00-commit-msg", "50-lipstick"})
+			ok, _, _ := g.status()
+			So(ok, ShouldBeTrue)
+
+			var out bytes.Buffer
+			printDryRun(&out)
+			So(out.String(), ShouldContainSubstring, "-echo mine\n+# lipstick hook dispatcher\n")
+			So(out.String(), ShouldContainSubstring, "--- "+path+"\n+++ "+path+"\n")
+			So(out.String(), ShouldContainSubstring, "--- /dev/null\n+++ "+filepath.Join(dir, "commit-msg.d", "50-lipstick")+"\n")
+
+			Convey("Files inside the working directory should be named relative to it", func() {
+				defer func(old string) { pwd = old }(pwd)
+				pwd = dir
+				out.Reset()
+				printDryRun(&out)
+				So(out.String(), ShouldContainSubstring, "--- a/commit-msg\n+++ b/commit-msg\n")
+				So(out.String(), ShouldContainSubstring, "--- /dev/null\n+++ b/"+filepath.Join("commit-msg.d", "50-lipstick")+"\n")
+			})
+
+			Convey("Uninstalling after it should plan no change at all", func() {
+				So(g.uninstall(), ShouldBeNil)
+				out.Reset()
+				printDryRun(&out)
+				So(out.String(), ShouldBeEmpty)
+			})
+		})
+	})
+}
+
+func TestListMappings(t *testing.T) {
+	c := &Config{
+		Words:   map[string]string{"docs": ":books:", "bugfix": ":bug:", "ui": ":lipstick:"},
+		Sources: map[string]string{"docs": "builtin", "bugfix": "builtin", "ui": ".lipstickrc"},
+	}
+
+	Convey("Given a substring filter", t, func() {
+		m, err := selectMappings(c, listOptions{filter: "bug"})
+		So(err, ShouldBeNil)
+		So(m, ShouldResemble, []mapping{{Key: "bugfix", Value: ":bug:"}})
+	})
+
+	Convey("Given a regular expression filter and a value sort", t, func() {
+		m, err := selectMappings(c, listOptions{filter: "^(docs|ui)$", sortBy: "value", source: true})
+		So(err, ShouldBeNil)
+		So(m, ShouldResemble, []mapping{
+			{Key: "docs", Value: ":books:", Source: "builtin"},
+			{Key: "ui", Value: ":lipstick:", Source: ".lipstickrc"},
+		})
+	})
+
+	Convey("Given a filter that is not a valid regular expression", t, func() {
+		_, err := selectMappings(c, listOptions{filter: "fix("})
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "invalid filter")
+		So(exitCodeOf(listAvailable(".", listOptions{format: "text", filter: "fix("})), ShouldEqual, exitUsage)
+	})
+
+	Convey("Given the machine readable formats", t, func() {
+		m, _ := selectMappings(c, listOptions{filter: "ui"})
+		var b bytes.Buffer
+		So(writeJSON(&b, m, false), ShouldBeNil)
+		So(b.String(), ShouldEqual, "[\n  {\n    \"key\": \"ui\",\n    \"value\": \":lipstick:\"\n  }\n]\n")
+		b.Reset()
+		So(writeCSV(&b, m, false), ShouldBeNil)
+		So(b.String(), ShouldEqual, "key,value\nui,:lipstick:\n")
+		b.Reset()
+		So(writeTOML(&b, m, false), ShouldBeNil)
+		out := &Config{}
+		_, err := toml.Decode(b.String(), out)
+		So(err, ShouldBeNil)
+		So(out.Words, ShouldResemble, map[string]string{"ui": ":lipstick:"})
+	})
+}
+
+func TestCompleteKeys(t *testing.T) {
+	c := &Config{Words: map[string]string{"feature": ":sparkles:", "fix": ":bug:", "docs": ":books:"}}
+
+	Convey("Given a partial token at the end of a message", t, func() {
+		So(completeKeys(c, `"add login :f`), ShouldResemble, []string{"add login :feature:", "add login :fix:"})
+		So(completeKeys(c, ":fe"), ShouldResemble, []string{":feature:"})
+		So(completeKeys(c, ":"), ShouldHaveLength, 3)
+	})
+
+	Convey("Given a word that is not a token", t, func() {
+		So(completeKeys(c, "fix"), ShouldBeEmpty)
+		So(completeKeys(c, ":fix: done"), ShouldBeEmpty)
+	})
+
+	Convey("Given keys written in different cases", t, func() {
+		words := map[string]string{"bugFix": ":bug:", "docs": ":books:", "remove_logging": ":mute:"}
+		exact := &Config{Words: words}
+		So(completeKeys(exact, ":Bug"), ShouldBeEmpty)
+		So(completeKeys(exact, ":bugF"), ShouldResemble, []string{":bugFix:"})
+
+		insensitive := &Config{Words: words, Policy: Policy{Match: matchCaseInsensitive}}
+		So(completeKeys(insensitive, ":Bug"), ShouldResemble, []string{":bugFix:"})
+		So(completeKeys(insensitive, ":REMOVE_"), ShouldResemble, []string{":remove_logging:"})
+		So(completeKeys(insensitive, ":remove-"), ShouldBeEmpty)
+
+		normalized := &Config{Words: words, Policy: Policy{Match: matchNormalized}}
+		So(completeKeys(normalized, ":Bug"), ShouldResemble, []string{":bugFix:"})
+		So(completeKeys(normalized, ":bug-f"), ShouldResemble, []string{":bugFix:"})
+		So(completeKeys(normalized, ":removeLog"), ShouldResemble, []string{":remove_logging:"})
+	})
+
+	Convey("Given a partial token of another table", t, func() {
+		c := &Config{
+			Words:  map[string]string{"core": ":gear:"},
+			Tables: map[string]Table{"teams": {Delimiter: "@", Words: map[string]string{"core": "@core-team", "web": "@web-team"}}},
+			Policy: Policy{Match: matchCaseInsensitive},
+		}
+		So(completeKeys(c, "ping @C"), ShouldResemble, []string{"ping @core@"})
+		So(completeKeys(c, "@"), ShouldResemble, []string{"@core@", "@web@"})
+		So(completeKeys(c, ":c"), ShouldResemble, []string{":core:"})
+	})
+}
+
+func TestLanguageServer(t *testing.T) {
+	frame := func(msg string) string {
+		return fmt.Sprintf("Content-Length: %d\r\n\r\n%s", len(msg), msg)
+	}
+	var in bytes.Buffer
+	for _, msg := range []string{
+		`{"jsonrpc":"2.0","id":1,"method":"initialize","params":{}}`,
+		`{"jsonrpc":"2.0","method":"textDocument/didOpen","params":{"textDocument":{"uri":"file:///m","text":"✨ :bugfix: :nope: :fe"}}}`,
+		`{"jsonrpc":"2.0","id":2,"method":"textDocument/completion","params":{"textDocument":{"uri":"file:///m"},"position":{"line":0,"character":21}}}`,
+		`{"jsonrpc":"2.0","id":3,"method":"textDocument/hover","params":{"textDocument":{"uri":"file:///m"},"position":{"line":0,"character":4}}}`,
+		`{"jsonrpc":"2.0","id":4,"method":"textDocument/codeAction","params":{"textDocument":{"uri":"file:///m"}}}`,
+		`{"jsonrpc":"2.0","id":5,"method":"shutdown"}`,
+		`{"jsonrpc":"2.0","method":"exit"}`,
+	} {
+		in.WriteString(frame(msg))
+	}
+	var out bytes.Buffer
+	err := serveLSP(&in, &out)
+
+	// Split the framed output back into messages.
+	var msgs []map[string]interface{}
+	for _, part := range strings.Split(out.String(), "Content-Length: ")[1:] {
+		var m map[string]interface{}
+		json.Unmarshal([]byte(part[strings.Index(part, "{"):]), &m)
+		msgs = append(msgs, m)
+	}
+
+	Convey("Given a session with a commit message", t, func() {
+		So(err, ShouldBeNil)
+		So(msgs, ShouldHaveLength, 6)
+
+		Convey("Unknown tokens are reported with UTF-16 columns", func() {
+			diags := msgs[1]["params"].(map[string]interface{})["diagnostics"].([]interface{})
+			So(diags, ShouldHaveLength, 1)
+			d := diags[0].(map[string]interface{})
+			So(d["message"], ShouldEqual, "unknown token :nope:")
+			So(d["range"].(map[string]interface{})["start"].(map[string]interface{})["character"], ShouldEqual, 11)
+		})
+
+		Convey("The token at the cursor is completed", func() {
+			items := msgs[2]["result"].([]interface{})
+			So(items, ShouldHaveLength, 1)
+			So(items[0].(map[string]interface{})["label"], ShouldEqual, ":feature:")
+			So(items[0].(map[string]interface{})["detail"], ShouldEqual, "✨ :sparkles:")
+		})
+
+		Convey("Hover shows the mapping", func() {
+			contents := msgs[3]["result"].(map[string]interface{})["contents"].(map[string]interface{})
+			So(contents["value"], ShouldStartWith, "`:bugfix:` → 🐛 :bug:")
+		})
+
+		Convey("The code action applies replace", func() {
+			actions := msgs[4]["result"].([]interface{})
+			So(actions, ShouldHaveLength, 1)
+			edits := actions[0].(map[string]interface{})["edit"].(map[string]interface{})["changes"].(map[string]interface{})["file:///m"].([]interface{})
+			So(edits[0].(map[string]interface{})["newText"], ShouldEqual, "✨ :bug: :nope: :fe")
+		})
+	})
+}
+
+func TestServeAPI(t *testing.T) {
+	Convey("Given text with mapped values", t, func() {
+		c := &Config{Words: map[string]string{"bugfix": ":bug:", "fix": ":bug:", "party": ":bug::tada:"}}
+		So(reverse(c, ":bug: and :bug::tada:"), ShouldEqual, ":bugfix: and :party:")
+	})
+
+	Convey("Given the API", t, func() {
+		configs, err := newConfigManager(pwd)
+		So(err, ShouldBeNil)
+		h := apiHandler(configs)
+		post := func(path, body string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("POST", path, strings.NewReader(body)))
+			return w
+		}
+
+		w := post("/replace", `{"text": ":bugfix: fix it"}`)
+		So(w.Code, ShouldEqual, 200)
+		So(w.Body.String(), ShouldEqual, "{\"text\":\":bug: fix it\"}\n")
+
+		w = post("/lint", `{"text": ":nope: fix it"}`)
+		So(w.Body.String(), ShouldContainSubstring, `"ok":false`)
+		So(w.Body.String(), ShouldContainSubstring, `unknown token :nope:`)
+
+		So(post("/replace", `not json`).Code, ShouldEqual, 400)
+		So(post("/mappings", ``).Code, ShouldEqual, 405)
+
+		w = post("/replace", `{"text": "`+strings.Repeat("a", maxRequestBody)+`"}`)
+		So(w.Code, ShouldEqual, 413)
+		So(w.Body.String(), ShouldContainSubstring, "request body over")
+
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/mappings?filter=^bugfix$", nil))
+		So(w.Body.String(), ShouldContainSubstring, `"key":"bugfix"`)
+	})
+}
+
+func TestConfigManager(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "lipstick")
+	defer os.RemoveAll(dir)
+	rc := filepath.Join(dir, ".lipstickrc")
+
+	Convey("Given a manager watching a repository without a .lipstickrc", t, func() {
+		m, err := newConfigManager(dir)
+		So(err, ShouldBeNil)
+		So(m.Config().Sources["bugfix"], ShouldEqual, builtinSource)
+		events := m.Subscribe()
+
+		Convey("Nothing happens until a file changes", func() {
+			ok, err := m.Reload()
+			So(ok, ShouldBeFalse)
+			So(err, ShouldBeNil)
+		})
+
+		Convey("A new .lipstickrc is swapped in and announced", func() {
+			ioutil.WriteFile(rc, []byte("[commitKinds]\nbugfix = \"B\"\n"), 0644)
+			ok, err := m.Reload()
+			So(ok, ShouldBeTrue)
+			So(err, ShouldBeNil)
+			So(m.Config().Words, ShouldResemble, map[string]string{"bugfix": "B"})
+			So((<-events).Config.Words["bugfix"], ShouldEqual, "B")
+
+			Convey("A broken one is reported and the last good config kept", func() {
+				ioutil.WriteFile(rc, []byte("[commitKinds\n"), 0644)
+				ok, err := m.Reload()
+				So(ok, ShouldBeFalse)
+				So(err, ShouldNotBeNil)
+				So(m.Err(), ShouldEqual, err)
+				So(m.Config().Words["bugfix"], ShouldEqual, "B")
+				ev := <-events
+				So(ev.Err, ShouldEqual, err)
+				So(ev.Config.Words["bugfix"], ShouldEqual, "B")
+			})
+		})
+
+		Reset(func() {
+			m.Unsubscribe(events)
+			os.Remove(rc)
+		})
+	})
+}
+
+func TestConfigFormats(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "lipstick")
+	defer os.RemoveAll(dir)
+	write := func(name, data string) {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644)
+	}
+
+	Convey("Given a repository without a lipstick config", t, func() {
+		write("package.json", `{"name": "app"}`)
+		_, err := readLocalConfig(dir)
+		So(err, ShouldEqual, errNoLocalConfig)
+	})
+
+	Convey("Given configs in several formats", t, func() {
+		write("package.json", `{"name": "app", "lipstick": {"commitKinds": {"docs": "D", "ui": "U"}, "output": {"mode": "trailer"}}}`)
+		write("pyproject.toml", "[tool.black]\nline-length = 88\n\n[tool.lipstick.commitKinds]\nui = \"P\"\ntests = \"T\"\n")
+		write(".lipstickrc.yaml", "commitKinds:\n  docs: \"Y\"\noutput:\n  trailer: Type\n")
+		cfg, err := readLocalConfig(dir)
+		So(err, ShouldBeNil)
+
+		Convey("They are merged with the higher precedence files winning", func() {
+			So(cfg.Words, ShouldResemble, map[string]string{"docs": "Y", "ui": "U", "tests": "T"})
+			So(cfg.Output, ShouldResemble, Output{Mode: "trailer", Trailer: "Type"})
+			So(cfg.Sources["ui"], ShouldEqual, filepath.Join(dir, "package.json"))
+			So(cfg.Files, ShouldResemble, []string{
+				filepath.Join(dir, "pyproject.toml"),
+				filepath.Join(dir, "package.json"),
+				filepath.Join(dir, ".lipstickrc.yaml"),
+			})
+		})
+	})
+
+	Convey("Given a broken config file", t, func() {
+		write(".lipstickrc.json", `{"commitKinds": `)
+		_, err := readLocalConfig(dir)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldStartWith, filepath.Join(dir, ".lipstickrc.json"))
+	})
+}
+
+func TestExtends(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "lipstick")
+	defer os.RemoveAll(dir)
+	write := func(name, data string) {
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755)
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644)
+	}
+	write("team/base.toml", "[commitKinds]\ndocs = \"D\"\nui = \"U\"\n\n[output]\nmode = \"trailer\"\n")
+	write("team/extra.yaml", "extends: [base.toml]\ncommitKinds:\n  ui: \"Y\"\n")
+	write("app/.lipstickrc", "extends = [\"../team/extra.yaml\"]\n\n[commitKinds]\ndocs = \"L\"\n")
+
+	Convey("Given a config extending files that extend others", t, func() {
+		cfg, err := readLocalConfig(filepath.Join(dir, "app"))
+		So(err, ShouldBeNil)
+		So(cfg.Words, ShouldResemble, map[string]string{"docs": "L", "ui": "Y"})
+		So(cfg.Output.mode(), ShouldEqual, modeTrailer)
+		So(cfg.Sources["ui"], ShouldEqual, filepath.Join(dir, "team/extra.yaml"))
+		So(cfg.Files, ShouldResemble, []string{
+			filepath.Join(dir, "team/base.toml"),
+			filepath.Join(dir, "team/extra.yaml"),
+			filepath.Join(dir, "app/.lipstickrc"),
+		})
+	})
+
+	Convey("Given a cycle", t, func() {
+		write("team/base.toml", "extends = [\"../app/.lipstickrc\"]\n")
+		_, err := readLocalConfig(filepath.Join(dir, "app"))
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldEqual, "extends cycle: "+
+			filepath.Join(dir, "app/.lipstickrc")+" -> "+
+			filepath.Join(dir, "team/extra.yaml")+" -> "+
+			filepath.Join(dir, "team/base.toml")+" -> "+
+			filepath.Join(dir, "app/.lipstickrc"))
+	})
+
+	Convey("Given a missing file", t, func() {
+		write("app/.lipstickrc", "extends = [\"nope.toml\"]\n")
+		_, err := readLocalConfig(filepath.Join(dir, "app"))
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldStartWith, filepath.Join(dir, "app/.lipstickrc")+": extends "+filepath.Join(dir, "app/nope.toml")+": ")
+	})
+
+	Convey("Given a preset committed to the repository", t, func() {
+		if _, err := exec.LookPath("git"); err != nil {
+			t.Skip("git binary not available")
+		}
+		git := func(args ...string) {
+			cmd := exec.Command("git", args...)
+			cmd.Dir = dir
+			cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=T", "GIT_AUTHOR_EMAIL=t@x", "GIT_COMMITTER_NAME=T", "GIT_COMMITTER_EMAIL=t@x")
+			if out, err := cmd.CombinedOutput(); err != nil {
+				t.Fatal(string(out))
+			}
+		}
+		write("presets/lipstick.toml", "extends = [\"common.toml\"]\n\n[commitKinds]\nui = \"G\"\n")
+		write("presets/common.toml", "[commitKinds]\ndocs = \"C\"\n")
+		git("init", "-q")
+		git("add", "presets")
+		git("commit", "-q", "-m", "presets")
+		// The working copy no longer matters once committed.
+		write("presets/lipstick.toml", "[commitKinds]\nui = \"changed\"\n")
+		write("app/.lipstickrc", "extends = [\"git:HEAD:presets/lipstick.toml\"]\n")
+		app := filepath.Join(dir, "app")
+
+		cfg, err := readLocalConfig(app)
+		So(err, ShouldBeNil)
+		So(cfg.Words, ShouldResemble, map[string]string{"docs": "C", "ui": "G"})
+		So(cfg.Sources["docs"], ShouldEqual, "git:HEAD:presets/common.toml")
+
+		write("app/.lipstickrc", "extends = [\"git:HEAD:presets/missing.toml\"]\n")
+		_, err = readLocalConfig(app)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldEndWith, "extends git:HEAD:presets/missing.toml: path presets/missing.toml: not found")
+	})
+}
+
+func TestPathRules(t *testing.T) {
+	Convey("Given path globs", t, func() {
+		So(globPattern("docs/").MatchString("docs/api/index.md"), ShouldBeTrue)
+		So(globPattern("docs/*.md").MatchString("docs/api/index.md"), ShouldBeFalse)
+		So(globPattern("**/*.md").MatchString("Readme.md"), ShouldBeTrue)
+		So(globPattern("**/*.md").MatchString("ui/notes.md"), ShouldBeTrue)
+		So(globPattern("ui/**/*.css").MatchString("ui/a/b/c.css"), ShouldBeTrue)
+		So(globPattern("ui/?.go").MatchString("ui/ab.go"), ShouldBeFalse)
+	})
+
+	c := &Config{
+		Words: map[string]string{"docs": ":books:", "ui": ":lipstick:", "feature": ":sparkles:"},
+		Paths: map[string][]string{"docs/": {"docs"}, "ui/**": {"ui", "feature"}},
+	}
+	files := []string{"docs/a.md", "docs/b.md", "ui/button.go", "main.go"}
+
+	Convey("Given a message without a kind", t, func() {
+		suggested, warnings := checkPaths(c, "fix typo\n", files)
+		So(suggested, ShouldEqual, "docs")
+		So(warnings, ShouldBeEmpty)
+		So(addKind("\nfix typo\n# comment\n", suggested), ShouldEqual, "\n:docs: fix typo\n# comment\n")
+	})
+
+	Convey("Given a kind that matches only some of the staged files", t, func() {
+		suggested, warnings := checkPaths(c, ":feature: new button", files)
+		So(suggested, ShouldEqual, "")
+		So(warnings, ShouldResemble, []string{"changes under docs/ expect :docs:, not :feature:"})
+	})
+
+	Convey("Given files no rule covers", t, func() {
+		suggested, warnings := checkPaths(c, "refactor", []string{"main.go"})
+		So(suggested, ShouldEqual, "")
+		So(warnings, ShouldBeEmpty)
+	})
+}
+
+func TestKindRules(t *testing.T) {
+	c := &Config{
+		Words: map[string]string{"bugfix": ":bug:", "docs": ":books:"},
+		Kinds: map[string]KindRules{"bugfix": {
+			Template: "Cause:\nFix:\n",
+			Sections: []string{"Cause", "Fix"},
+			Trailers: []string{"Fixes"},
+		}},
+	}
+
+	Convey("Given a message that follows the rules of its kind", t, func() {
+		msg := ":bugfix: stop the crash\n\nCause: a nil map\nFix:\n  make the map first\n\nFixes: #12\n# Please enter the commit message\n"
+		So(kindProblems(c, msg), ShouldBeEmpty)
+		So(lintMessage(c, msg), ShouldBeEmpty)
+	})
+
+	Convey("Given a message missing a section and a trailer", t, func() {
+		msg := "# comment\n:bugfix: stop the crash\n\nFix:\nCause: a nil map\n"
+		So(kindProblems(c, msg), ShouldResemble, []problem{
+			{Line: 3, End: 4, Message: "the Fix: section is empty"},
+			{Line: 1, End: 23, Message: ":bugfix: commits need a Fixes: trailer"},
+		})
+	})
+
+	Convey("Given a trailer below a scissors line", t, func() {
+		msg := ":bugfix: x\n\nCause: a\nFix: b\n# ------------------------ >8 ------------------------\nFixes: #1\n"
+		So(kindProblems(c, msg), ShouldHaveLength, 1)
+	})
+
+	Convey("Given kinds without rules", t, func() {
+		So(kindProblems(c, ":docs: typo"), ShouldBeEmpty)
+	})
+
+	Convey("Given a message of comments only", t, func() {
+		So(kindProblems(c, "# :bugfix:"), ShouldBeEmpty)
+		So(kindProblems(c, "# :bugfix:\n\n# ------------------------ >8 ------------------------\n"), ShouldBeEmpty)
+		So(lintMessage(c, "# :bugfix:"), ShouldBeEmpty)
+	})
+
+	Convey("Given a kind only in comments and the diff below a scissors line", t, func() {
+		msg := ":docs: typo\n# :bugfix: in a comment\n# ------------------------ >8 ------------------------\n+ :bugfix: in the diff\n"
+		So(kindProblems(c, msg), ShouldBeEmpty)
+	})
+
+	Convey("Given a message for the prepare-commit-msg hook", t, func() {
+		editor := "\n# Please enter the commit message\n"
+		So(prepareMessage(c, editor, ""), ShouldEqual, editor)
+		So(prepareMessage(c, editor, "bugfix"), ShouldEqual,
+			"\n\nCause:\nFix:\n\n# Please enter the commit message\n")
+		out := prepareMessage(c, ":bugfix: stop the crash\n", "docs")
+		So(out, ShouldEqual, ":bugfix: stop the crash\n\nCause:\nFix:\n")
+		So(prepareMessage(c, out, ""), ShouldEqual, out)
+	})
+}
+
+func TestRunReplace(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "lipstick")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, ".lipstickrc"), []byte(`
+[commitKinds]
+bugfix = ":bug:"
+
+[kinds.bugfix]
+trailers = ["Fixes"]
+`), 0644)
+	msg := filepath.Join(dir, "msg")
+
+	Convey("Given a message on stdin", t, func() {
+		var out bytes.Buffer
+		in := ":bugfix:  two  spaces\r\n\r\nFixes: #1"
+		So(runReplace(dir, nil, false, strings.NewReader(in), &out), ShouldBeNil)
+		So(out.String(), ShouldEqual, ":bug:  two  spaces\r\n\r\nFixes: #1")
+	})
+
+	Convey("Given files and stdin", t, func() {
+		ioutil.WriteFile(msg, []byte("a :bugfix:\n\nFixes: #2\n"), 0644)
+		var out bytes.Buffer
+		err := runReplace(dir, []string{msg, "-"}, false, strings.NewReader("b\n"), &out)
+		So(err, ShouldBeNil)
+		So(out.String(), ShouldEqual, "a :bug:\n\nFixes: #2\nb\n")
+
+		Convey("--in-place rewrites the files", func() {
+			So(runReplace(dir, []string{msg}, true, nil, &out), ShouldBeNil)
+			data, _ := ioutil.ReadFile(msg)
+			So(string(data), ShouldEqual, "a :bug:\n\nFixes: #2\n")
+		})
+
+		Convey("--in-place refuses stdin", func() {
+			So(exitCodeOf(runReplace(dir, []string{msg, "-"}, true, nil, &out)), ShouldEqual, exitUsage)
+		})
+	})
+
+	Convey("Given a file that does not exist", t, func() {
+		ioutil.WriteFile(msg, []byte(":bugfix: x\n"), 0644)
+		var out bytes.Buffer
+		So(exitCodeOf(runReplace(dir, []string{"missing", msg}, false, nil, &out)), ShouldEqual, exitIO)
+		So(out.String(), ShouldEqual, ":bug: x\n")
+	})
+
+	Convey("Given a commit message that breaks the rules of its kind", t, func() {
+		ioutil.WriteFile(msg, []byte(":bugfix: no trailer\n"), 0644)
+		So(exitCodeOf(commitMsg(dir, msg)), ShouldEqual, exitRejected)
+		data, _ := ioutil.ReadFile(msg)
+		So(string(data), ShouldEqual, ":bugfix: no trailer\n")
+
+		ioutil.WriteFile(msg, []byte(":bugfix: x\n\nFixes: #3\n"), 0644)
+		So(commitMsg(dir, msg), ShouldBeNil)
+		data, _ = ioutil.ReadFile(msg)
+		So(string(data), ShouldEqual, ":bug: x\n\nFixes: #3\n")
+	})
+}
+
+func TestReplaceWriter(t *testing.T) {
+	words := map[string]string{"bugfix": ":bug:", "docs": ":books:", "a": "A"}
+	in := ":bugfix: :docs::a: :nope:a: ::a: :bugfixes: :docs"
+	want := ":bug: :books:A :nopeA :A :bugfixes: :docs"
+
+	Convey("Given input written in one go", t, func() {
+		So(replace(&Config{Words: words}, in), ShouldEqual, want)
+	})
+
+	Convey("Given tokens split across every possible write", t, func() {
+		for size := 1; size < len(in); size++ {
+			var b bytes.Buffer
+			w := newReplacer(&Config{Words: words}, &b)
+			for i := 0; i < len(in); i += size {
+				end := i + size
+				if end > len(in) {
+					end = len(in)
+				}
+				w.Write([]byte(in[i:end]))
+			}
+			w.Flush()
+			So(b.String(), ShouldEqual, want)
+		}
+	})
+
+	Convey("Given a run of key characters longer than any key", t, func() {
+		long := ":" + strings.Repeat("x", 100) + ":docs:"
+		So(replace(&Config{Words: words}, long), ShouldEqual, ":"+strings.Repeat("x", 100)+":books:")
+	})
+}
+
+// update rewrites the golden files of the corpus from the current output,
+// to be reviewed with git diff.
+var update = flag.Bool("update", false, "rewrite the golden files in testdata/replace")
+
+// corpusInputs returns the inputs of the corpus in testdata/replace, each
+// with a .golden file holding what the builtin config makes of it.
+func corpusInputs(tb testing.TB) []string {
+	inputs, err := filepath.Glob(filepath.Join("testdata", "replace", "*.in"))
+	if err != nil || len(inputs) == 0 {
+		tb.Fatal("no inputs in testdata/replace")
+	}
+	return inputs
+}
+
+func TestReplaceCorpus(t *testing.T) {
+	for _, in := range corpusInputs(t) {
+		data, err := ioutil.ReadFile(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		golden := strings.TrimSuffix(in, ".in") + ".golden"
+		out := replace(cfg, string(data))
+		if *update {
+			ioutil.WriteFile(golden, []byte(out), 0644)
+		}
+		want, err := ioutil.ReadFile(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out != string(want) {
+			t.Errorf("%s: got %q, want %q", in, out, want)
+		}
+		var b bytes.Buffer
+		w := newReplacer(cfg, &b)
+		for i := range data {
+			w.Write(data[i : i+1])
+		}
+		w.Flush()
+		if b.String() != string(want) {
+			t.Errorf("%s written a byte at a time: got %q, want %q", in, b.String(), want)
+		}
+	}
+}
+
+func TestReplaceIdempotent(t *testing.T) {
+	var keys []string
+	for key := range cfg.Words {
+		keys = append(keys, key)
+	}
+	messages := []string{"", ":", "::", ":::"}
+	for _, in := range corpusInputs(t) {
+		data, _ := ioutil.ReadFile(in)
+		messages = append(messages, string(data))
+	}
+	for _, a := range keys {
+		messages = append(messages, ":"+a+":", "::"+a+"::", ":"+a+":"+a+":", cfg.Words[a]+a+":")
+		for _, b := range keys {
+			messages = append(messages, ":"+a+"::"+b+":", ":"+a+":"+b+":", ":"+a+": :"+b+":")
+		}
+	}
+	Convey("Given messages made of every key of the default config", t, func() {
+		for _, msg := range messages {
+			out := replace(cfg, msg)
+			So(replace(cfg, out), ShouldEqual, out)
+		}
+	})
+
+	Convey("Given values that are tokens or have colons", t, func() {
+		c := &Config{Words: map[string]string{"bugfix": ":bug:", "bug": ":beetle:", "fix": "fix:"}}
+		Convey("A value that shows up is already applied", func() {
+			So(replace(c, ":bugfix:"), ShouldEqual, ":bug:")
+			So(replace(c, ":bugfix:bug:"), ShouldEqual, ":bug:bug:")
+			So(replace(c, ":fix:bug:"), ShouldEqual, "fix:bug:")
+		})
+
+		Convey("A known token comes before a value", func() {
+			So(replace(c, ":bug:"), ShouldEqual, ":beetle:")
+			c := &Config{Words: map[string]string{"000": ":", "smile": ":-)"}}
+			So(replace(c, ":000:"), ShouldEqual, ":")
+			So(replace(c, "::000::-)"), ShouldEqual, ":::-)")
+		})
+
+		Convey("A value is not glued to a ':' and key characters before it", func() {
+			So(replace(c, "::fix:"), ShouldEqual, "::fix:")
+			So(replace(c, ":nope:fix:"), ShouldEqual, ":nopefix:")
+			So(replace(c, ":nope::fix:"), ShouldEqual, ":nope::fix:")
+			So(replace(c, ":nope::bugfix:"), ShouldEqual, ":nope::bug:")
+		})
+	})
+}
+
+func TestMatchPolicy(t *testing.T) {
+	words := map[string]string{"removeLogging": ":mute:", "bugfix": ":bug:"}
+
+	Convey("Given keys normalized for matching", t, func() {
+		So(normalizeKey(matchExact, "removeLogging"), ShouldEqual, "removeLogging")
+		So(normalizeKey(matchCaseInsensitive, "RemoveLogging"), ShouldEqual, "removelogging")
+		for _, key := range []string{"removeLogging", "RemoveLogging", "remove-logging", "remove_logging", "REMOVE_LOGGING"} {
+			So(normalizeKey(matchNormalized, key), ShouldEqual, "remove-logging")
+		}
+		So(normalizeKey(matchNormalized, "v2Api"), ShouldEqual, "v2-api")
+	})
+
+	Convey("Given the default exact matching", t, func() {
+		c := &Config{Words: words}
+		So(replace(c, ":RemoveLogging: :remove-logging:"), ShouldEqual, ":RemoveLogging: :remove-logging:")
+	})
+
+	Convey("Given case-insensitive matching", t, func() {
+		c := &Config{Words: words, Policy: Policy{Match: matchCaseInsensitive}}
+		So(replace(c, ":RemoveLogging: :BUGFIX:"), ShouldEqual, ":mute: :bug:")
+		So(replace(c, ":remove-logging:"), ShouldEqual, ":remove-logging:")
+	})
+
+	Convey("Given normalized matching", t, func() {
+		c := &Config{Words: words, Policy: Policy{Match: matchNormalized}}
+		c.indexKeys()
+		So(replace(c, ":RemoveLogging: :remove-logging: :remove_logging:"), ShouldEqual, ":mute: :mute: :mute:")
+
+		Convey("Kinds are reported by the key in the config", func() {
+			So(messageKinds(c, ":remove_logging: quiet down"), ShouldResemble, []string{"removeLogging"})
+			out, kinds := stripKinds(c, ":Remove-Logging: quiet down")
+			So(out, ShouldEqual, "quiet down")
+			So(kinds, ShouldResemble, []string{"removeLogging"})
+		})
+	})
+
+	Convey("Given keys that collide", t, func() {
+		dir, _ := ioutil.TempDir("", "lipstick")
+		defer os.RemoveAll(dir)
+		rc := filepath.Join(dir, ".lipstickrc")
+		ioutil.WriteFile(rc, []byte("[policy]\nmatch = \"normalized\"\n\n[commitKinds]\nremoveLogging = \":mute:\"\nremove_logging = \":speaker:\"\ndocs = \":books:\"\n"), 0644)
+
+		Convey("The alphabetically first one is used", func() {
+			c, err := loadConfig(dir)
+			So(err, ShouldBeNil)
+			So(replace(c, ":remove-logging:"), ShouldEqual, ":mute:")
+			So(collisions(c), ShouldResemble, [][]string{{"removeLogging", "remove_logging"}})
+		})
+
+		Convey("config check reports them", func() {
+			var b bytes.Buffer
+			err := checkConfig(dir, &b)
+			So(exitCodeOf(err), ShouldEqual, exitConfig)
+			So(b.String(), ShouldEqual, ":removeLogging: ("+rc+"), :remove_logging: ("+rc+") match the same tokens, :removeLogging: is used\n")
+		})
+
+		Convey("Matching them exactly does not collide", func() {
+			ioutil.WriteFile(rc, []byte("[commitKinds]\nremoveLogging = \":mute:\"\nremove_logging = \":speaker:\"\n"), 0644)
+			var b bytes.Buffer
+			So(checkConfig(dir, &b), ShouldBeNil)
+			So(b.String(), ShouldBeEmpty)
+		})
+
+		Convey("An unknown match is an error", func() {
+			ioutil.WriteFile(rc, []byte("[policy]\nmatch = \"fuzzy\"\n"), 0644)
+			_, err := loadConfig(dir)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, `unknown match "fuzzy"`)
+		})
+	})
+}
+
+func TestAutocorrect(t *testing.T) {
+	words := map[string]string{"bugfix": ":bug:", "docs": ":books:", "tests": ":white_check_mark:", "test": ":test_tube:"}
+
+	Convey("Given misspelled keys", t, func() {
+		So(editDistance("bugix", "bugfix"), ShouldEqual, 1)
+		So(editDistance("bgufix", "bugfix"), ShouldEqual, 1)
+		So(editDistance("", "docs"), ShouldEqual, 4)
+		c := &Config{Words: words}
+		So(suggestKeys(c, "bugix"), ShouldResemble, []string{"bugfix"})
+		So(suggestKeys(c, "doc"), ShouldResemble, []string{"docs"})
+		So(suggestKeys(c, "tesst"), ShouldResemble, []string{"test", "tests"})
+		So(suggestKeys(c, "party"), ShouldBeEmpty)
+	})
+
+	Convey("Given autocorrect set to apply", t, func() {
+		c := &Config{Words: words, Policy: Policy{Autocorrect: autocorrectApply}}
+		out, err := autocorrect(c, ":bugix: stop the crash :bug: :party:")
+		So(err, ShouldBeNil)
+		So(out, ShouldEqual, ":bugfix: stop the crash :bug: :party:")
+
+		Convey("Tokens close to several keys are left alone", func() {
+			out, err := autocorrect(c, ":tesst: more")
+			So(err, ShouldBeNil)
+			So(out, ShouldEqual, ":tesst: more")
+		})
+
+		Convey("The hook replaces the corrected token", func() {
+			out, err := processMessage(c, ":bugix: stop the crash")
+			So(err, ShouldBeNil)
+			So(out, ShouldEqual, ":bug: stop the crash")
+		})
+	})
+
+	Convey("Given autocorrect set to fail", t, func() {
+		c := &Config{Words: words, Policy: Policy{Autocorrect: autocorrectFail}}
+		_, err := autocorrect(c, ":tesst: more")
+		So(exitCodeOf(err), ShouldEqual, exitRejected)
+		So(err.Error(), ShouldEqual, "unknown token :tesst:, did you mean :test: or :tests:?")
+		out, err := autocorrect(c, ":docs: :party:")
+		So(err, ShouldBeNil)
+		So(out, ShouldEqual, ":docs: :party:")
+
+		Convey("Comments and the diff of git commit -v are not checked", func() {
+			msg := ":docs: typo\n# :tesst: in a comment\n# ------------------------ >8 ------------------------\n+\tstd::tesst::run()\n+ :bugix:\n"
+			out, err := autocorrect(c, msg)
+			So(err, ShouldBeNil)
+			So(out, ShouldEqual, msg)
+			c.Policy.Autocorrect = autocorrectApply
+			out, err = autocorrect(c, msg)
+			So(err, ShouldBeNil)
+			So(out, ShouldEqual, msg)
+			out, _ = autocorrect(c, ":docs: typo\n\n:bugix: later\n# :bugix:\n")
+			So(out, ShouldEqual, ":docs: typo\n\n:bugfix: later\n# :bugix:\n")
+		})
+	})
+
+	Convey("Given autocorrect set to prompt", t, func() {
+		c := &Config{Words: words, Policy: Policy{Autocorrect: autocorrectPrompt}}
+		defer func(open func() (io.ReadWriteCloser, error)) { openTTY = open }(openTTY)
+		var asked bytes.Buffer
+		answer := func(s string) {
+			openTTY = func() (io.ReadWriteCloser, error) {
+				return struct {
+					io.Reader
+					io.Writer
+					io.Closer
+				}{strings.NewReader(s), &asked, ioutil.NopCloser(nil)}, nil
+			}
+		}
+
+		Convey("The token is replaced when confirmed", func() {
+			answer("\n")
+			out, _ := autocorrect(c, ":bugix: crash")
+			So(out, ShouldEqual, ":bugfix: crash")
+			So(asked.String(), ShouldEqual, "lipstick: replace :bugix: with :bugfix:? [Y/n] ")
+		})
+
+		Convey("The token is kept when declined", func() {
+			answer("n\n")
+			out, _ := autocorrect(c, ":bugix: crash")
+			So(out, ShouldEqual, ":bugix: crash")
+		})
+
+		Convey("The token is kept without a terminal", func() {
+			openTTY = func() (io.ReadWriteCloser, error) { return nil, os.ErrNotExist }
+			out, err := autocorrect(c, ":bugix: crash")
+			So(err, ShouldBeNil)
+			So(out, ShouldEqual, ":bugix: crash")
+		})
+	})
+}
+
+func TestTables(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "lipstick")
+	defer os.RemoveAll(dir)
+	rc := filepath.Join(dir, ".lipstickrc")
+	ioutil.WriteFile(rc, []byte(`[commitKinds]
+docs = ":books:"
+bugfix = ":bug:"
+
+[tables.teams]
+delimiter = "@"
+
+[tables.teams.words]
+core = "@ana @bo"
+web = "@cy"
+
+[tables.status]
+delimiter = "#"
+
+[tables.status.words]
+wip = "🚧"
+`), 0644)
+
+	Convey("Given a config with named tables", t, func() {
+		c, err := loadConfig(dir)
+		So(err, ShouldBeNil)
+
+		Convey("Every table is replaced with its own delimiter", func() {
+			So(replace(c, ":docs: #wip# ask @core@, not @nobody@"), ShouldEqual, ":books: 🚧 ask @ana @bo, not @nobody@")
+			out, _ := annotate(&Config{Words: c.Words, Tables: c.Tables, Output: Output{Mode: modeTrailer}}, ":bugfix: fix it for @web@")
+			So(out, ShouldEqual, "fix it for @cy\n\nKind: bugfix")
+		})
+
+		Convey("Tokens of one table are not replaced by another", func() {
+			So(replace(c, "#core# @wip@ :web:"), ShouldEqual, "#core# @wip@ :web:")
+		})
+
+		Convey("list shows each table", func() {
+			m, err := selectMappings(c, listOptions{})
+			So(err, ShouldBeNil)
+			var b bytes.Buffer
+			writeText(&b, m, false)
+			So(b.String(), ShouldEqual, "\ncommitKinds\n:bugfix:   :bug:\n:docs:     :books:\n\nstatus\n#wip#      🚧\n\nteams\n@core@     @ana @bo\n@web@      @cy\n\n")
+
+			m, err = selectMappings(c, listOptions{table: "teams", filter: "web", source: true})
+			So(err, ShouldBeNil)
+			So(m, ShouldResemble, []mapping{{Key: "web", Value: "@cy", Source: rc, Table: "teams", delim: "@"}})
+			b.Reset()
+			writeJSON(&b, m, true)
+			So(b.String(), ShouldContainSubstring, `"table": "teams"`)
+			b.Reset()
+			writeTOML(&b, m, false)
+			So(b.String(), ShouldEqual, "[tables.\"teams\"]\ndelimiter = \"@\"\n\n[tables.\"teams\".words]\n\"web\" = \"@cy\"\n")
+
+			m, _ = selectMappings(c, listOptions{filter: "^(docs|wip)$"})
+			b.Reset()
+			writeTOML(&b, m, false)
+			So(b.String(), ShouldEqual, "[commitKinds]\n\"docs\" = \":books:\"\n\n[tables.\"status\"]\ndelimiter = \"#\"\n\n[tables.\"status\".words]\n\"wip\" = \"🚧\"\n")
+
+			m, _ = selectMappings(c, listOptions{filter: "^(docs|web)$"})
+			b.Reset()
+			writeMarkdown(&b, m, false)
+			So(b.String(), ShouldEqual, "| Key | Value | Table |\n| --- | --- | --- |\n| `:docs:` | :books: | commitKinds |\n| `@web@` | @cy | teams |\n")
+
+			_, err = selectMappings(c, listOptions{table: "scopes"})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("The listed TOML reads back the same", func() {
+			m, err := selectMappings(c, listOptions{})
+			So(err, ShouldBeNil)
+			var b bytes.Buffer
+			So(writeTOML(&b, m, true), ShouldBeNil)
+			out := &Config{}
+			_, err = toml.Decode(b.String(), out)
+			So(err, ShouldBeNil)
+			So(out.Words, ShouldResemble, c.Words)
+			So(out.Tables, ShouldResemble, c.Tables)
+		})
+
+		Convey("The shown config reads back the same", func() {
+			var b bytes.Buffer
+			So(showConfig(dir, &b), ShouldBeNil)
+			out := &Config{}
+			_, err := toml.Decode(b.String(), out)
+			So(err, ShouldBeNil)
+			So(out.Tables, ShouldResemble, c.Tables)
+		})
+	})
+
+	Convey("Given tables with delimiters that cannot work", t, func() {
+		words := map[string]string{"a": "b"}
+		So(checkTables(map[string]Table{"teams": {Delimiter: "@", Words: words}}), ShouldBeNil)
+		So(checkTables(map[string]Table{"teams": {Delimiter: "", Words: words}}), ShouldNotBeNil)
+		So(checkTables(map[string]Table{"teams": {Delimiter: "@@", Words: words}}), ShouldNotBeNil)
+		So(checkTables(map[string]Table{"teams": {Delimiter: "-", Words: words}}), ShouldNotBeNil)
+		So(checkTables(map[string]Table{"teams": {Delimiter: ":", Words: words}}), ShouldNotBeNil)
+		So(checkTables(map[string]Table{"a": {Delimiter: "@"}, "b": {Delimiter: "@"}}).Error(), ShouldEqual, `table b: the delimiter "@" is already used by a`)
+	})
+}
+
+// naiveGlues reports whether s starts with a key of c and the delimiter d.
+func naiveGlues(c *Config, d byte, s string) bool {
+	j := 0
+	for j < len(s) && isKeyByte(s[j]) {
+		j++
+	}
+	_, ok := c.lookup(s[:j])
+	return ok && j > 0 && j < len(s) && s[j] == d
+}
+
+// naiveReplace is the tokenizer spelled out the slow way, for commit kinds
+// delimited by ':' and the other tables by theirs: a delimiter followed by
+// a known key and the same delimiter is a token unless its value would join
+// a delimiter and key characters written as text before it into a known
+// token, otherwise the longest value with a delimiter is copied as it is,
+// everything else is copied.
+func naiveReplace(c *Config, msg string) string {
+	tables := map[byte]*Config{':': c}
+	for _, name := range c.tableNames() {
+		tables[c.Tables[name].Delimiter[0]] = c.table(name)
+	}
+	isDelim := func(s string) bool {
+		for i := 0; i < len(s); i++ {
+			if tables[s[i]] != nil {
+				return true
+			}
+		}
+		return false
+	}
+	var b strings.Builder
+	open, openDelim, tail := false, byte(0), ""
+	for i := 0; i < len(msg); {
+		if d := msg[i]; tables[d] != nil {
+			j := i + 1
+			for j < len(msg) && isKeyByte(msg[j]) {
+				j++
+			}
+			key, ok := tables[d].lookup(msg[i+1 : j])
+			v := tables[d].Words[key]
+			if ok && j > i+1 && j < len(msg) && msg[j] == d && !(open && naiveGlues(tables[openDelim], openDelim, tail+v+msg[j+1:])) {
+				b.WriteString(v)
+				open = false
+				i = j + 1
+				continue
+			}
+		}
+		applied := ""
+		for _, t := range tables {
+			for _, v := range t.Words {
+				if isDelim(v) && len(v) > len(applied) && strings.HasPrefix(msg[i:], v) {
+					applied = v
+				}
+			}
+		}
+		if applied != "" {
+			b.WriteString(applied)
+			open = false
+			i += len(applied)
+			continue
+		}
+		switch c := msg[i]; {
+		case tables[c] != nil:
+			open, openDelim, tail = true, c, ""
+		case open && isKeyByte(c):
+			tail += string(c)
+		default:
+			open = false
+		}
+		b.WriteByte(msg[i])
+		i++
+	}
+	return b.String()
+}
+
+func FuzzReplace(f *testing.F) {
+	for _, in := range corpusInputs(f) {
+		data, _ := ioutil.ReadFile(in)
+		f.Add(string(data), uint(len(data)/2))
+	}
+	f.Add("#ready# @core@: @ops@ :wip:#done# @@ana@", uint(9))
+	// Values that are shortcodes and text with colons, a token mapped to
+	// itself and keys that collide unless matched exactly.
+	words := map[string]string{
+		"bugfix": ":bug:", "docs": "📚", "tests": "✅",
+		"fix": "fix: ", "wip": "🚧 WIP:", "Wip": "wip", "self": ":self:",
+		"smile": ":-)", "removeLogging": "🔇", "remove-logging": "🔈", "colon": ":",
+	}
+	// Tables whose values use the delimiters of the others.
+	tables := map[string]Table{
+		"status": {Delimiter: "#", Words: map[string]string{"wip": "#draft#", "done": "✔", "ready": "@nobody@ #done#"}},
+		"teams":  {Delimiter: "@", Words: map[string]string{"core": "@ana @bo", "ana": "Ana", "ops": ":nope:"}},
+	}
+	// Values that start with a known token are replaced again, so these
+	// are not idempotent.
+	chained := map[string]string{"bugfix": ":bug:", "bug": ":beetle:", "fix": "fix: ", "list": ":bug: and :fix:"}
+	var configs []*Config
+	for _, match := range []string{matchExact, matchCaseInsensitive, matchNormalized} {
+		c := &Config{Words: words, Policy: Policy{Match: match}}
+		c.indexKeys()
+		configs = append(configs, c)
+	}
+	configs = append(configs, &Config{Words: words, Tables: tables}, &Config{Words: chained})
+	f.Fuzz(func(t *testing.T, msg string, split uint) {
+		for i, c := range configs {
+			out := replace(c, msg)
+			if want := naiveReplace(c, msg); out != want {
+				t.Fatalf("%s: replace(%q) = %q, want %q", c.Policy.Match, msg, out, want)
+			}
+			if again := replace(c, out); again != out && i < len(configs)-1 {
+				t.Fatalf("%s: replace(%q) = %q, replacing again gives %q", c.Policy.Match, msg, out, again)
+			}
+			n := int(split % uint(len(msg)+1))
+			var b bytes.Buffer
+			w := newReplacer(c, &b)
+			w.Write([]byte(msg[:n]))
+			w.Write([]byte(msg[n:]))
+			w.Flush()
+			if b.String() != out {
+				t.Fatalf("%s: %q split at %d gives %q, want %q", c.Policy.Match, msg, n, b.String(), out)
+			}
+		}
+		if out := replace(cfg, msg); replace(cfg, out) != out {
+			t.Fatalf("replace(%q) with the builtin config is not idempotent", msg)
+		}
+	})
+}
+
+func FuzzDecodeConfig(f *testing.F) {
+	builtin, _ := Asset("config/lipstickrc.toml")
+	sample, _ := ioutil.ReadFile("lipstickrc.sample")
+	f.Add(builtin, uint8(0))
+	f.Add(sample, uint8(0))
+	f.Add([]byte("commitKinds:\n  docs: \":books:\"\noutput:\n  mode: trailer\n"), uint8(1))
+	f.Add([]byte(`{"commitKinds": {"docs": ":books:"}, "kinds": {"docs": {"trailers": ["Refs"]}}}`), uint8(2))
+	f.Add([]byte(`{"lipstick": {"commitKinds": {"a": "b"}}}`), uint8(3))
+	f.Add([]byte("[tool.lipstick.commitKinds]\ndocs = \":books:\"\n"), uint8(4))
+	// Used to hang the TOML lexer.
+	f.Add([]byte("[ "), uint8(0))
+	f.Add([]byte("t = \"\"\""), uint8(0))
+	decoders := []func([]byte, *Config) (bool, error){
+		decodeTOML, decodeYAML, decodeJSON, decodePackageJSON, decodePyproject,
+	}
+	f.Fuzz(func(t *testing.T, data []byte, format uint8) {
+		c := &Config{}
+		found, err := decoders[int(format)%len(decoders)](data, c)
+		if err != nil || !found {
+			return
+		}
+		var msg strings.Builder
+		for key := range c.Words {
+			msg.WriteString(":" + key + ": ")
+		}
+		// Whatever decodes must be usable without panicking.
+		annotate(c, msg.String())
+		kindProblems(c, msg.String())
+		for key, value := range c.Words {
+			if key == "" || strings.IndexFunc(key, func(r rune) bool { return r > 0x7f || !isKeyByte(byte(r)) }) >= 0 {
+				continue
+			}
+			if out := replace(c, ":"+key+":"); out != value {
+				t.Fatalf("key %q maps to %q but :%s: becomes %q", key, value, key, out)
+			}
+		}
+	})
+}
+
+// benchmarkInput is about 16MB of commit messages, like a history dump.
+func benchmarkInput() []byte {
+	line := "commit 3f2a :bugfix: fix the crash in :docs: when the :nope: token shows up\n"
+	return bytes.Repeat([]byte(line), 16<<20/len(line))
+}
+
+func BenchmarkReplaceWriter(b *testing.B) {
+	in := benchmarkInput()
+	b.SetBytes(int64(len(in)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		replaceStream(cfg, bytes.NewReader(in), ioutil.Discard)
+	}
+}
+
+func BenchmarkReplaceString(b *testing.B) {
+	in := string(benchmarkInput())
+	b.SetBytes(int64(len(in)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		replace(cfg, in)
+	}
+}
+
+func TestExitCodes(t *testing.T) {
+	Convey("Given errors from lipstick, git and the standard library", t, func() {
+		So(exitCodeOf(nil), ShouldEqual, exitOK)
+		So(exitCodeOf(fmt.Errorf("boom")), ShouldEqual, exitFailure)
+		So(exitCodeOf(usageErrorf("no range")), ShouldEqual, exitUsage)
+		So(exitCodeOf(errNoRepository), ShouldEqual, exitNoRepo)
+		So(exitCodeOf(fmt.Errorf("open: %w", git.ErrNotRepository)), ShouldEqual, exitNoRepo)
+		_, err := os.Open("/does/not/exist")
+		So(exitCodeOf(err), ShouldEqual, exitIO)
+		So(exitCodeOf(fmt.Errorf("hook: %w", errRejected)), ShouldEqual, exitRejected)
+		So(exitCodeOf(errors.Join(usageErrorf("a"), ioError(err))), ShouldEqual, exitIO)
+	})
+
+	Convey("Given a config file that does not decode", t, func() {
+		dir, _ := ioutil.TempDir("", "lipstick")
+		defer os.RemoveAll(dir)
+		ioutil.WriteFile(filepath.Join(dir, ".lipstickrc"), []byte("[commitKinds\n"), 0644)
+		_, err := loadEmojiMap(dir)
+		So(exitCodeOf(err), ShouldEqual, exitConfig)
+	})
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/jesusrmoreno/lipstick/internal/git"
+)
+
+// globPattern turns a path glob into a regular expression matching paths
+// from the top of the repository. * and ? stay within a directory, **
+// crosses directories and a trailing / matches everything below it.
+func globPattern(glob string) *regexp.Regexp {
+	if strings.HasSuffix(glob, "/") {
+		glob += "**"
+	}
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			b.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case glob[i] == '*':
+			b.WriteString("[^/]*")
+		case glob[i] == '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
+
+// messageKinds returns the keys of the known tokens in msg.
+func messageKinds(cfg *Config, msg string) []string {
+	var kinds []string
+	for _, t := range tokenPattern.FindAllString(msg, -1) {
+		if key, ok := cfg.lookup(t[1 : len(t)-1]); ok {
+			kinds = appendUnique(kinds, key)
+		}
+	}
+	return kinds
+}
+
+// checkPaths compares msg with the [paths] rules for the staged files. For
+// a message without a kind it returns the kind suggested for most of the
+// files. Otherwise it returns a warning for every pattern whose files allow
+// none of the kinds in the message.
+func checkPaths(cfg *Config, msg string, files []string) (string, []string) {
+	globs := make([]string, 0, len(cfg.Paths))
+	for glob, kinds := range cfg.Paths {
+		if len(kinds) > 0 {
+			globs = append(globs, glob)
+		}
+	}
+	sort.Strings(globs)
+	matched := map[string]int{}
+	for _, glob := range globs {
+		re := globPattern(glob)
+		for _, f := range files {
+			if re.MatchString(f) {
+				matched[glob]++
+			}
+		}
+	}
+	if len(matched) == 0 {
+		return "", nil
+	}
+
+	chosen := messageKinds(cfg, msg)
+	if len(chosen) == 0 {
+		votes := map[string]int{}
+		for glob, n := range matched {
+			votes[cfg.Paths[glob][0]] += n
+		}
+		best := ""
+		for kind, n := range votes {
+			if best == "" || n > votes[best] || n == votes[best] && kind < best {
+				best = kind
+			}
+		}
+		return best, nil
+	}
+
+	var warnings []string
+	for _, glob := range globs {
+		if matched[glob] == 0 {
+			continue
+		}
+		allowed := false
+		for _, k := range cfg.Paths[glob] {
+			for _, c := range chosen {
+				allowed = allowed || k == c
+			}
+		}
+		if !allowed {
+			warnings = append(warnings, fmt.Sprintf("changes under %s expect :%s:, not :%s:",
+				glob, strings.Join(cfg.Paths[glob], ": or :"), strings.Join(chosen, ": :")))
+		}
+	}
+	return "", warnings
+}
+
+// addKind puts a :kind: token at the start of the subject, the first line
+// that is neither blank nor a comment.
+func addKind(msg, kind string) string {
+	lines := strings.SplitAfter(msg, "\n")
+	for i, l := range lines {
+		if strings.TrimSpace(l) != "" && !strings.HasPrefix(l, "#") {
+			lines[i] = ":" + kind + ": " + l
+			return strings.Join(lines, "")
+		}
+	}
+	return ":" + kind + ": " + msg
+}
+
+// applyPathRules runs checkPaths against the files staged in the
+// repository, logging the warnings. Outside a git repository msg is
+// returned as is.
+func applyPathRules(cfg *Config, msg string) string {
+	if len(cfg.Paths) == 0 {
+		return msg
+	}
+	repo, err := git.OpenDir(cfg.Dir)
+	if err != nil {
+		return msg
+	}
+	files, err := repo.Staged()
+	if err != nil {
+		log.Println("warning: could not read the staged files:", err)
+		return msg
+	}
+	suggested, warnings := checkPaths(cfg, msg, files)
+	for _, w := range warnings {
+		log.Println("warning:", w)
+	}
+	if suggested != "" {
+		log.Println("no kind given, using :" + suggested + ": for the staged files")
+		return addKind(msg, suggested)
+	}
+	return msg
+}
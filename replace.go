@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/natefinch/atomic"
+)
+
+// processMessage runs msg through everything the commit-msg hook does:
+// autocorrection, the [paths] rules, the rules of its kinds and the output
+// mode.
+func processMessage(cfg *Config, msg string) (string, error) {
+	msg, err := autocorrect(cfg, msg)
+	if err != nil {
+		return "", err
+	}
+	msg = applyPathRules(cfg, msg)
+	if err := checkKindRules(cfg, msg); err != nil {
+		return "", err
+	}
+	out, kinds := annotate(cfg, msg)
+	if cfg.Output.mode() == modeNotes {
+		if err := savePendingKinds(cfg.Dir, kinds); err != nil {
+			return "", fmt.Errorf("could not save kinds for the note: %v", err)
+		}
+	}
+	return out, nil
+}
+
+// commitMsg processes the message file of the commit-msg hook, run in dir,
+// in place.
+func commitMsg(dir, path string) error {
+	if path == "" {
+		return usageErrorf("no message file given")
+	}
+	cfg, err := loadEmojiMap(dir)
+	if err != nil {
+		return err
+	}
+	path = inDir(dir, path)
+	data, err := readFile(path)
+	if err != nil {
+		return err
+	}
+	out, err := processMessage(cfg, string(data))
+	if err != nil || out == string(data) {
+		return err
+	}
+	return writeFile(path, out)
+}
+
+// runReplace applies the mappings of dir to every named file, or stdin for
+// "-" and when no files are given, streaming the results to stdout, or back
+// to the files with inPlace. Relative names are relative to dir. Everything
+// outside the tokens is kept byte for byte. An input that fails does not
+// stop the others, the errors of all of them are returned together.
+func runReplace(dir string, names []string, inPlace bool, stdin io.Reader, stdout io.Writer) error {
+	if len(names) == 0 {
+		names = []string{"-"}
+	}
+	for _, name := range names {
+		if name == "-" && inPlace {
+			return usageErrorf("--in-place needs files, it cannot rewrite stdin")
+		}
+	}
+	cfg, err := loadEmojiMap(dir)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, name := range names {
+		debugf("replacing %s", name)
+		if name == "-" {
+			err = replaceStream(cfg, stdin, stdout)
+		} else if inPlace {
+			err = replaceFile(cfg, inDir(dir, name))
+		} else {
+			// Errors opening files already name them.
+			var f *os.File
+			if f, err = os.Open(inDir(dir, name)); err == nil {
+				err = replaceStream(cfg, f, stdout)
+				f.Close()
+			}
+		}
+		if err != nil {
+			errs = append(errs, ioError(err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// replaceStream copies r to w with the mappings of every table applied.
+func replaceStream(cfg *Config, r io.Reader, w io.Writer) error {
+	rw := newReplacer(cfg, w)
+	if _, err := io.Copy(rw, r); err != nil {
+		return err
+	}
+	return rw.Flush()
+}
+
+// replaceFile applies the mappings to the file at path, replacing it
+// atomically once the whole file has been written.
+func replaceFile(cfg *Config, path string) error {
+	if dryRun != nil {
+		data, err := readFile(path)
+		if err != nil {
+			return err
+		}
+		return writeFile(path, replace(cfg, string(data)))
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(replaceStream(cfg, f, pw))
+	}()
+	if err := atomic.WriteFile(path, pr); err != nil {
+		pr.CloseWithError(err)
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/jesusrmoreno/lipstick/internal/git"
+)
+
+// backupPrefix is where the pre-rewrite tip of a branch is kept, matching
+// the convention used by git filter-branch.
+const backupPrefix = "refs/original/"
+
+// rewriteTarget works out which branch a revision range ends on. Only
+// branches can be rewritten since the result has to be stored somewhere.
+func rewriteTarget(repo *git.Repository, spec string) (string, error) {
+	fields := strings.Fields(spec)
+	tip := ""
+	for _, f := range fields {
+		if strings.HasPrefix(f, "^") {
+			continue
+		}
+		if i := strings.Index(f, ".."); i >= 0 {
+			f = f[i+2:]
+		}
+		tip = f
+	}
+	if tip == "" || tip == "HEAD" || tip == "@" {
+		ref, err := repo.Symref("HEAD")
+		if err != nil {
+			return "", err
+		}
+		if ref == "" {
+			return "", fmt.Errorf("HEAD is detached, name the branch to rewrite")
+		}
+		return ref, nil
+	}
+	ref, err := repo.ExpandRef(tip)
+	if err != nil || !strings.HasPrefix(ref, "refs/heads/") {
+		return "", fmt.Errorf("%s is not a branch", tip)
+	}
+	return ref, nil
+}
+
+// rewriteHistory applies the lipstick output mode to the message of every
+// commit in spec and moves the branch to the rewritten history. Trees,
+// authors and dates are kept; signatures cannot survive and are dropped
+// with a warning. With dryRun set the message changes are printed as a diff
+// and nothing is written.
+func rewriteHistory(dir, spec string, dryRun, force bool) error {
+	if spec == "" {
+		return usageErrorf("no revision range given")
+	}
+	repo, err := git.OpenDir(dir)
+	if err != nil {
+		return err
+	}
+	cfg, err := loadEmojiMap(dir)
+	if err != nil {
+		return err
+	}
+	ref, err := rewriteTarget(repo, spec)
+	if err != nil {
+		return err
+	}
+	oldTip, err := repo.Ref(ref)
+	if err != nil {
+		return err
+	}
+	backup := backupPrefix + ref
+	if _, err := repo.Ref(backup); err == nil && !force && !dryRun {
+		return usageErrorf("backup %s already exists, use --force to overwrite it", backup)
+	}
+	commits, err := repo.Log(spec)
+	if err != nil {
+		return err
+	}
+
+	inRange := map[git.Hash]*git.Commit{}
+	for _, c := range commits {
+		inRange[c.Hash] = c
+	}
+	mapped := map[git.Hash]git.Hash{}
+	changed := 0
+
+	// rewrite handles parents before children so each commit can point at
+	// its rewritten parents.
+	var rewrite func(h git.Hash) (git.Hash, error)
+	rewrite = func(h git.Hash) (git.Hash, error) {
+		if n, ok := mapped[h]; ok {
+			return n, nil
+		}
+		c, ok := inRange[h]
+		if !ok {
+			return h, nil
+		}
+		n := *c
+		n.Parents = make([]git.Hash, len(c.Parents))
+		dirty := false
+		for i, p := range c.Parents {
+			np, err := rewrite(p)
+			if err != nil {
+				return h, err
+			}
+			n.Parents[i] = np
+			dirty = dirty || np != p
+		}
+		var kinds []string
+		n.Message, kinds = annotate(cfg, c.Message)
+		if n.Message != c.Message {
+			dirty = true
+			changed++
+			if dryRun {
+				short := c.Hash.String()[:7]
+				fmt.Printf("commit %s\n", short)
+				fmt.Print(unifiedDiff("a/"+short, "b/"+short, c.Message, n.Message))
+			}
+		}
+		if !dirty {
+			mapped[h] = h
+			return h, nil
+		}
+		if c.Signed() {
+			log.Printf("warning: commit %s is signed, its signature will be dropped", c.Hash.String()[:7])
+			n.Extra = nil
+			for _, e := range c.Extra {
+				if e.Key != "gpgsig" && e.Key != "gpgsig-sha256" {
+					n.Extra = append(n.Extra, e)
+				}
+			}
+		}
+		if dryRun {
+			mapped[h] = h
+			return h, nil
+		}
+		nh, err := repo.WriteCommit(&n)
+		if err != nil {
+			return h, err
+		}
+		if len(kinds) > 0 {
+			if err := repo.AddNote(cfg.Output.notesRef(), nh, formatNote(cfg, kinds)); err != nil {
+				return h, err
+			}
+		}
+		mapped[h] = nh
+		return nh, nil
+	}
+
+	for i := len(commits) - 1; i >= 0; i-- {
+		if _, err := rewrite(commits[i].Hash); err != nil {
+			return fmt.Errorf("unable to rewrite history: %w", err)
+		}
+	}
+	newTip, err := rewrite(oldTip)
+	if err != nil {
+		return fmt.Errorf("unable to rewrite history: %w", err)
+	}
+	if dryRun {
+		log.Printf("%d of %d commits on %s would be rewritten", changed, len(commits), ref)
+		return nil
+	}
+	if newTip == oldTip {
+		log.Println("nothing to rewrite on", ref)
+		return nil
+	}
+	if err := repo.UpdateRef(backup, oldTip, git.ZeroHash); err != nil {
+		return fmt.Errorf("unable to write backup ref: %w", err)
+	}
+	if err := repo.UpdateRef(ref, newTip, oldTip); err != nil {
+		return fmt.Errorf("unable to update %s: %w", ref, err)
+	}
+	log.Printf("rewrote %d commits on %s, the old history is kept in %s", changed, ref, backup)
+	return nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// serveDescription documents the API in `lipstick help serve`. The help
+// template only indents the first line, so the rest carry their own.
+const serveDescription = `Serves the mappings of the repository at --repo as JSON over HTTP.
+   The config is reloaded whenever one of its files changes.
+
+   GET  /mappings[?filter=text&sort=key|value]
+        200 [{"key": "bugfix", "value": ":bug:", "source": "builtin"}, ...]
+   POST /replace  {"text": ":bugfix: fix it"}
+        200 {"text": ":bug: fix it"}
+   POST /reverse  {"text": ":bug: fix it"}
+        200 {"text": ":bugfix: fix it"}
+   POST /lint     {"text": ":nope: fix it"}
+        200 {"ok": false, "problems": [{"line": 0, "start": 0, "end": 6,
+             "message": "unknown token :nope:"}]}
+
+   Lines and columns in problems are zero based byte offsets. Bodies over
+   1 MiB are rejected with 413. Errors are {"error": "message"} with a 4xx
+   or 5xx status.`
+
+// maxRequestBody caps the body of the POST endpoints, a commit message is
+// far smaller.
+const maxRequestBody = 1 << 20
+
+// The timeouts of the server, so slow or stuck clients can't hold
+// connections open forever.
+const (
+	readHeaderTimeout = 5 * time.Second
+	readTimeout       = 30 * time.Second
+	writeTimeout      = 30 * time.Second
+)
+
+// textRequest is the body of the POST endpoints.
+type textRequest struct {
+	Text string `json:"text"`
+}
+
+// apiHandler returns the HTTP handler for the API described in
+// serveDescription.
+func apiHandler(configs *configManager) http.Handler {
+	mux := http.NewServeMux()
+	withConfig := func(method string, fn func(http.ResponseWriter, *http.Request, *Config)) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != method {
+				w.Header().Set("Allow", method)
+				writeAPIError(w, http.StatusMethodNotAllowed, "use "+method)
+				return
+			}
+			fn(w, r, configs.Config())
+		}
+	}
+	withText := func(fn func(*Config, string) interface{}) http.HandlerFunc {
+		return withConfig("POST", func(w http.ResponseWriter, r *http.Request, cfg *Config) {
+			var req textRequest
+			err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBody)).Decode(&req)
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				writeAPIError(w, http.StatusRequestEntityTooLarge, "request body over "+strconv.Itoa(maxRequestBody)+" bytes")
+				return
+			} else if err != nil {
+				writeAPIError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+				return
+			}
+			writeAPI(w, http.StatusOK, fn(cfg, req.Text))
+		})
+	}
+
+	mux.HandleFunc("/mappings", withConfig("GET", func(w http.ResponseWriter, r *http.Request, cfg *Config) {
+		q := r.URL.Query()
+		opts := listOptions{filter: q.Get("filter"), sortBy: q.Get("sort"), source: true}
+		mappings, err := selectMappings(cfg, opts)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeAPI(w, http.StatusOK, mappings)
+	}))
+	mux.HandleFunc("/replace", withText(func(cfg *Config, text string) interface{} {
+		return textRequest{replace(cfg, text)}
+	}))
+	mux.HandleFunc("/reverse", withText(func(cfg *Config, text string) interface{} {
+		return textRequest{reverse(cfg, text)}
+	}))
+	mux.HandleFunc("/lint", withText(func(cfg *Config, text string) interface{} {
+		problems := lintMessage(cfg, text)
+		return map[string]interface{}{"ok": len(problems) == 0, "problems": problems}
+	}))
+	return mux
+}
+
+func writeAPI(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, msg string) {
+	writeAPI(w, status, map[string]string{"error": msg})
+}
+
+// serve runs the API on addr for the repository in repo.
+func serve(addr, repo string) error {
+	dir := pwd
+	if repo != "" {
+		if !isDir(repo) {
+			return usageErrorf("%s is not a directory", repo)
+		}
+		dir = repo
+	}
+	configs, err := newConfigManager(dir)
+	if err != nil {
+		return configError(err)
+	}
+	go configs.Watch(time.Second, nil)
+	log.Println("serving", dir, "on", addr)
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           apiHandler(configs),
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+	}
+	return server.ListenAndServe()
+}
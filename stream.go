@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"strings"
+)
+
+// replaceWriter applies mapping tables, each with keys between two of its
+// delimiters as in :key: or @team@, to the text written to it and passes the
+// result on to w, so inputs of any size can be replaced in constant memory.
+// The end of the input is held back until it can be decided, so Flush must
+// be called after the last write.
+//
+// All tables are applied in a single pass, so no value is ever scanned
+// again, and replacing is idempotent unless a value starts with a known
+// token, running the hook again over a processed message changes nothing:
+//   - a value with a delimiter in it, such as an emoji shortcode, is
+//     already applied wherever it shows up and is copied as it is, so its
+//     delimiters never pair up with the text around it. A known token
+//     comes first, so :bug: is still replaced when bug is a key;
+//   - a token right after a delimiter and key characters that are text is
+//     left alone when its value would join them into a known token, as in
+//     "::fix:" with fix mapped to "fix: ".
+type replaceWriter struct {
+	w io.Writer
+	// tables holds the mappings of every table by its delimiter.
+	tables  [256]*Config
+	longest int // length of the longest token text that can match a key
+	// applied holds the values with a delimiter, lengths the lengths of
+	// those not shaped like a token by first byte, longest first.
+	applied map[string]bool
+	lengths map[byte][]int
+	// starts marks the bytes a token or an applied value can start with,
+	// only is that byte when there is a single one and -1 otherwise.
+	starts [256]bool
+	only   int
+	// hold is how much input it takes to decide what starts at a byte.
+	hold int
+	// open is set while the output ends with the delimiter openDelim and
+	// the key characters in tail, written as text, that could still start
+	// a token.
+	open      bool
+	openDelim byte
+	tail      []byte
+	buf       []byte // input not decided yet
+	out       []byte
+}
+
+// newReplaceWriter returns a writer applying the Words of every config in
+// tables to the tokens delimited by its key.
+func newReplaceWriter(tables map[byte]*Config, w io.Writer) *replaceWriter {
+	r := &replaceWriter{w: w, applied: map[string]bool{}, lengths: map[byte][]int{}}
+	delims := ""
+	for d, t := range tables {
+		r.tables[d] = t
+		r.starts[d] = true
+		delims += string(d)
+		if n := t.longestToken(); n > r.longest {
+			r.longest = n
+		}
+	}
+	seen := map[byte]map[int]bool{}
+	for _, t := range tables {
+		for _, value := range t.Words {
+			if !strings.ContainsAny(value, delims) || r.applied[value] {
+				continue
+			}
+			r.applied[value] = true
+			if len(value) > r.hold {
+				r.hold = len(value)
+			}
+			if len(tokenAt([]byte(value), value[0], len(value))) == len(value) && tables[value[0]] != nil {
+				continue
+			}
+			c := value[0]
+			r.starts[c] = true
+			if seen[c] == nil {
+				seen[c] = map[int]bool{}
+			}
+			if !seen[c][len(value)] {
+				seen[c][len(value)] = true
+				r.lengths[c] = append(r.lengths[c], len(value))
+			}
+		}
+	}
+	for _, lengths := range r.lengths {
+		sort.Sort(sort.Reverse(sort.IntSlice(lengths)))
+	}
+	r.only = -1
+	for c, ok := range r.starts {
+		if ok && r.only == -1 {
+			r.only = c
+		} else if ok {
+			r.only = -1
+			break
+		}
+	}
+	// A token and what follows it up to a key past its value.
+	if 2*r.longest+3 > r.hold {
+		r.hold = 2*r.longest + 3
+	}
+	return r
+}
+
+// newReplacer returns a writer applying commitKinds and every other table
+// of cfg to the text written to it.
+func newReplacer(cfg *Config, w io.Writer) *replaceWriter {
+	tables := cfg.delimitedTables()
+	tables[':'] = cfg
+	return newReplaceWriter(tables, w)
+}
+
+// isKeyByte reports whether c may appear in a :key: token.
+func isKeyByte(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '_' || c == '+' || c == '-'
+}
+
+// chunkSize bounds the output buffered for a single write.
+const chunkSize = 32 << 10
+
+func (r *replaceWriter) Write(p []byte) (int, error) {
+	for n := 0; n < len(p); n += chunkSize {
+		end := n + chunkSize
+		if end > len(p) {
+			end = len(p)
+		}
+		r.buf = append(r.buf, p[n:end]...)
+		if err := r.process(false); err != nil {
+			return n, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush writes out the input held back at the end.
+func (r *replaceWriter) Flush() error {
+	return r.process(true)
+}
+
+// process replaces what can be decided in buf, everything when final.
+func (r *replaceWriter) process(final bool) error {
+	r.out = r.out[:0]
+	b := r.buf
+	i := 0
+	for i < len(b) && (final || len(b)-i >= r.hold) {
+		c := b[i]
+		if !r.starts[c] {
+			j := r.nextStart(b, i+1)
+			for k := i; r.open && k < j; k++ {
+				r.text(b[k])
+			}
+			r.out = append(r.out, b[i:j]...)
+			i = j
+			continue
+		}
+		if v, n := r.token(b[i:]); n > 0 && !(r.open && r.glues(v, b[i+n:])) {
+			r.out = append(r.out, v...)
+			r.open = false
+			i += n
+			continue
+		}
+		if v := r.appliedAt(b[i:]); v != "" {
+			r.out = append(r.out, v...)
+			r.open = false
+			i += len(v)
+			continue
+		}
+		// Not a token: the delimiter is text and the one closing an
+		// unknown token may open the next.
+		r.out = append(r.out, c)
+		r.text(c)
+		i++
+	}
+	r.buf = r.buf[:copy(r.buf, b[i:])]
+	if len(r.out) == 0 {
+		return nil
+	}
+	_, err := r.w.Write(r.out)
+	return err
+}
+
+// text keeps track of the open tail as c is written as text.
+func (r *replaceWriter) text(c byte) {
+	switch {
+	case r.tables[c] != nil:
+		r.open, r.openDelim, r.tail = true, c, r.tail[:0]
+	case r.open && isKeyByte(c) && len(r.tail) < r.longest:
+		r.tail = append(r.tail, c)
+	default:
+		r.open = false
+	}
+}
+
+// glues reports whether the value v, written after the open tail and
+// followed by rest, would read as a known token.
+func (r *replaceWriter) glues(v string, rest []byte) bool {
+	if len(rest) > r.longest+1 {
+		rest = rest[:r.longest+1]
+	}
+	s := string(r.tail) + v + string(rest)
+	j := 0
+	for j < len(s) && isKeyByte(s[j]) {
+		j++
+	}
+	if j == 0 || j == len(s) || s[j] != r.openDelim {
+		return false
+	}
+	_, ok := r.tables[r.openDelim].lookup(s[:j])
+	return ok
+}
+
+// nextStart returns the index of the first byte from i on that may start
+// a token or an applied value, or len(b).
+func (r *replaceWriter) nextStart(b []byte, i int) int {
+	if r.only >= 0 {
+		if j := bytes.IndexByte(b[i:], byte(r.only)); j >= 0 {
+			return i + j
+		}
+		return len(b)
+	}
+	for i < len(b) && !r.starts[b[i]] {
+		i++
+	}
+	return i
+}
+
+// tokenAt returns the token delimited by delim s starts with, with a key
+// of at most max bytes, or "".
+func tokenAt(s []byte, delim byte, max int) []byte {
+	if len(s) == 0 || s[0] != delim {
+		return s[:0]
+	}
+	j := 1
+	for j < len(s) && j <= max && isKeyByte(s[j]) {
+		j++
+	}
+	if j == 1 || j == len(s) || s[j] != delim {
+		return s[:0]
+	}
+	return s[:j+1]
+}
+
+// appliedAt returns the longest value with a delimiter that b starts with.
+func (r *replaceWriter) appliedAt(b []byte) string {
+	var short []byte
+	if r.tables[b[0]] != nil {
+		short = tokenAt(b, b[0], r.hold)
+	}
+	for _, n := range r.lengths[b[0]] {
+		if len(short) > n {
+			break
+		}
+		if len(b) >= n && r.applied[string(b[:n])] {
+			return string(b[:n])
+		}
+	}
+	if len(short) > 0 && r.applied[string(short)] {
+		return string(short)
+	}
+	for _, n := range r.lengths[b[0]] {
+		if n < len(short) && r.applied[string(b[:n])] {
+			return string(b[:n])
+		}
+	}
+	return ""
+}
+
+// token returns the value of the token b starts with and its length, or a
+// length of 0 if b does not start with a known token.
+func (r *replaceWriter) token(b []byte) (string, int) {
+	t := r.tables[b[0]]
+	if t == nil {
+		return "", 0
+	}
+	tok := tokenAt(b, b[0], r.longest)
+	if len(tok) == 0 {
+		return "", 0
+	}
+	key, ok := t.lookup(string(tok[1 : len(tok)-1]))
+	if !ok {
+		return "", 0
+	}
+	return t.Words[key], len(tok)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// kindsTable is the name list and config check give the [commitKinds]
+// table.
+const kindsTable = "commitKinds"
+
+// Table is a named mapping table besides commitKinds, set in a
+// [tables.<name>] table, such as team mentions written @team@.
+type Table struct {
+	// Delimiter goes on both sides of the keys of its tokens, as ':' does
+	// for commit kinds.
+	Delimiter string            `toml:"delimiter" json:"delimiter" yaml:"delimiter"`
+	Words     map[string]string `toml:"words" json:"words" yaml:"words"`
+}
+
+// tableNames returns the names of the tables of cfg other than
+// commitKinds, sorted.
+func (cfg *Config) tableNames() []string {
+	names := make([]string, 0, len(cfg.Tables))
+	for name := range cfg.Tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// table returns a config holding only the mappings of the named table, for
+// lookups under the match policy of cfg.
+func (cfg *Config) table(name string) *Config {
+	t := &Config{Words: cfg.Tables[name].Words, Policy: cfg.Policy, Sources: map[string]string{}}
+	for key := range t.Words {
+		t.Sources[key] = cfg.Sources[tableSourceKey(name, key)]
+	}
+	t.indexKeys()
+	return t
+}
+
+// tableSourceKey is the key in Config.Sources of a mapping in a table.
+// Keys cannot contain a '.', so these never clash with commit kinds.
+func tableSourceKey(name, key string) string {
+	return name + "." + key
+}
+
+// checkTables returns an error for a table whose delimiter cannot be told
+// apart from keys, text or the delimiter of another table.
+func checkTables(tables map[string]Table) error {
+	used := map[string]string{":": kindsTable}
+	names := make([]string, 0, len(tables))
+	for name := range tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		d := tables[name].Delimiter
+		switch {
+		case name == kindsTable:
+			return fmt.Errorf("a table cannot be named %s, use [%s] for kinds", kindsTable, kindsTable)
+		case len(d) != 1 || d[0] <= ' ' || d[0] > '~' || isKeyByte(d[0]):
+			return fmt.Errorf("table %s: the delimiter must be one punctuation character, not %q", name, d)
+		case used[d] != "":
+			return fmt.Errorf("table %s: the delimiter %q is already used by %s", name, d, used[d])
+		}
+		used[d] = name
+	}
+	return nil
+}
+
+// delimitedTables returns the tables of cfg other than commitKinds by
+// their delimiter.
+func (cfg *Config) delimitedTables() map[byte]*Config {
+	tables := map[byte]*Config{}
+	for name, t := range cfg.Tables {
+		tables[t.Delimiter[0]] = cfg.table(name)
+	}
+	return tables
+}
+
+// replaceTables applies the tables of cfg other than commitKinds to msg.
+func replaceTables(cfg *Config, msg string) string {
+	if len(cfg.Tables) == 0 {
+		return msg
+	}
+	var b strings.Builder
+	w := newReplaceWriter(cfg.delimitedTables(), &b)
+	w.Write([]byte(msg))
+	w.Flush()
+	return b.String()
+}
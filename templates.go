@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/jesusrmoreno/lipstick/internal/git"
+)
+
+// KindRules are the extra rules for commits of one kind, set in a
+// [kinds.<key>] table.
+type KindRules struct {
+	// Template is added to the message by the prepare-commit-msg hook.
+	Template string `toml:"template" json:"template" yaml:"template"`
+	// Sections must appear as "Name:" lines with some text.
+	Sections []string `toml:"sections" json:"sections" yaml:"sections"`
+	// Trailers must appear in the last paragraph.
+	Trailers []string `toml:"trailers" json:"trailers" yaml:"trailers"`
+}
+
+// prepareHook is the body of the prepare-commit-msg hook used when a kind
+// has a template.
+var prepareHook = "# adds lipstick templates\nlipstick prepare-commit-msg \"$@\"\n"
+
+// hasTemplates reports whether any kind in cfg has a template.
+func hasTemplates(cfg *Config) bool {
+	for _, r := range cfg.Kinds {
+		if r.Template != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// messageBody splits msg into its lines, dropping comments and everything
+// below a scissors line the way git does when it cleans up a message. The
+// line numbers of the lines kept are returned too.
+func messageBody(msg string) ([]string, []int) {
+	var lines []string
+	var numbers []int
+	for n, l := range strings.Split(msg, "\n") {
+		if strings.HasPrefix(l, "# ") && strings.Contains(l, ">8") {
+			break
+		}
+		if strings.HasPrefix(l, "#") {
+			continue
+		}
+		lines = append(lines, l)
+		numbers = append(numbers, n)
+	}
+	return lines, numbers
+}
+
+// kindProblems checks msg against the rules of the kinds it uses. Only the
+// lines git keeps are looked at, a message with none has no kinds.
+func kindProblems(cfg *Config, msg string) []problem {
+	lines, numbers := messageBody(msg)
+	subject, subjectLine := -1, 0
+	for i, l := range lines {
+		if strings.TrimSpace(l) != "" {
+			subject, subjectLine = i, numbers[i]
+			break
+		}
+	}
+	if subject < 0 {
+		return nil
+	}
+	var problems []problem
+	for _, kind := range messageKinds(cfg, strings.Join(lines, "\n")) {
+		rules := cfg.Kinds[kind]
+		for _, s := range rules.Sections {
+			heading := s + ":"
+			found := -1
+			for i, l := range lines {
+				if strings.HasPrefix(l, heading) {
+					found = i
+					break
+				}
+			}
+			if found < 0 {
+				problems = append(problems, problem{
+					Line: subjectLine, End: len(lines[subject]),
+					Message: fmt.Sprintf(":%s: commits need a %s section", kind, heading),
+				})
+			} else if !sectionHasText(lines[found:], heading, rules.Sections) {
+				problems = append(problems, problem{
+					Line: numbers[found], End: len(heading),
+					Message: fmt.Sprintf("the %s section is empty", heading),
+				})
+			}
+		}
+		for _, t := range rules.Trailers {
+			if !hasTrailer(lines, t) {
+				problems = append(problems, problem{
+					Line: subjectLine, End: len(lines[subject]),
+					Message: fmt.Sprintf(":%s: commits need a %s: trailer", kind, t),
+				})
+			}
+		}
+	}
+	return problems
+}
+
+// sectionHasText reports whether the section starting at lines[0] has text
+// after its heading, before the next blank line or section.
+func sectionHasText(lines []string, heading string, sections []string) bool {
+	if strings.TrimSpace(lines[0][len(heading):]) != "" {
+		return true
+	}
+	for _, l := range lines[1:] {
+		if strings.TrimSpace(l) == "" {
+			return false
+		}
+		for _, s := range sections {
+			if strings.HasPrefix(l, s+":") {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// hasTrailer reports whether the last paragraph of lines has a trailer
+// with the given key.
+func hasTrailer(lines []string, key string) bool {
+	end := len(lines)
+	for end > 0 && strings.TrimSpace(lines[end-1]) == "" {
+		end--
+	}
+	prefix := strings.ToLower(key) + ":"
+	for i := end - 1; i >= 0 && strings.TrimSpace(lines[i]) != ""; i-- {
+		l := strings.ToLower(lines[i])
+		if strings.HasPrefix(l, prefix) && strings.TrimSpace(l[len(prefix):]) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// prepareMessage adds the template of the kind chosen in msg, or of the
+// suggested kind when msg has none, after the message and before git's
+// comments. A template that is already there is not added again.
+func prepareMessage(cfg *Config, msg, suggested string) string {
+	kind := suggested
+	if kinds := messageKinds(cfg, msg); len(kinds) > 0 {
+		kind = kinds[0]
+	}
+	template := strings.Trim(cfg.Kinds[kind].Template, "\n")
+	if template == "" || strings.Contains(msg, strings.SplitN(template, "\n", 2)[0]) {
+		return msg
+	}
+	lines := strings.SplitAfter(msg, "\n")
+	i := 0
+	for i < len(lines) && !strings.HasPrefix(lines[i], "#") {
+		i++
+	}
+	text := strings.TrimRight(strings.Join(lines[:i], ""), "\n")
+	comments := strings.Join(lines[i:], "")
+	if comments != "" {
+		comments = "\n" + comments
+	}
+	// An empty subject stays on the first line for the editor.
+	return text + "\n\n" + template + "\n" + comments
+}
+
+// suggestKind returns the kind the [paths] rules suggest for the staged
+// files, if any.
+func suggestKind(cfg *Config, msg string) string {
+	if len(cfg.Paths) == 0 {
+		return ""
+	}
+	repo, err := git.OpenDir(cfg.Dir)
+	if err != nil {
+		return ""
+	}
+	files, err := repo.Staged()
+	if err != nil {
+		return ""
+	}
+	suggested, _ := checkPaths(cfg, msg, files)
+	return suggested
+}
+
+// prepareCommitMsg is run by the prepare-commit-msg hook in dir with git's
+// arguments: the message file and where the message came from. Merges,
+// squashes and amends already have a message and are left alone.
+func prepareCommitMsg(dir string, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("prepare-commit-msg needs the message file")
+	}
+	if len(args) > 1 {
+		switch args[1] {
+		case "merge", "squash", "commit":
+			return nil
+		}
+	}
+	cfg, err := loadEmojiMap(dir)
+	if err != nil {
+		return err
+	}
+	path := inDir(dir, args[0])
+	data, err := readFile(path)
+	if err != nil {
+		return err
+	}
+	msg := string(data)
+	out := prepareMessage(cfg, msg, suggestKind(cfg, msg))
+	if out == msg {
+		return nil
+	}
+	return writeFile(path, out)
+}
+
+// checkKindRules logs every rule of its kinds msg breaks and returns
+// errRejected if there are any.
+func checkKindRules(cfg *Config, msg string) error {
+	problems := kindProblems(cfg, msg)
+	for _, p := range problems {
+		log.Println("error:", p.Message)
+	}
+	if len(problems) > 0 {
+		return errRejected
+	}
+	return nil
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jesusrmoreno/lipstick/internal/git"
+)
+
+var errNoRepository = errors.New("Not a repository (no .git, .hg or .jj in the current directory)")
+
+// vcs is a version control system lipstick can hook into.
+type vcs interface {
+	// name identifies the backend in messages.
+	name() string
+	install(cfg *Config) error
+	uninstall() error
+	// status reports whether lipstick is hooked in and the file that holds
+	// the hook.
+	status() (bool, string, error)
+}
+
+// detectVCS returns a backend for every version control system found in
+// dir. A jj repository colocated with git yields both.
+func detectVCS(dir string) ([]vcs, error) {
+	var found []vcs
+	if isDir(filepath.Join(dir, ".jj")) {
+		found = append(found, jjVCS{root: dir})
+	}
+	if isDir(filepath.Join(dir, ".hg")) {
+		found = append(found, hgVCS{root: dir})
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+		gitDir, err := git.Find(dir)
+		if err != nil {
+			return nil, err
+		}
+		repo, err := git.Open(gitDir)
+		if err != nil {
+			return nil, err
+		}
+		hooks, err := gitHooksDir(repo, dir)
+		if err != nil {
+			return nil, err
+		}
+		found = append(found, gitVCS{hooksDir: hooks})
+	}
+	if len(found) == 0 {
+		return nil, errNoRepository
+	}
+	return found, nil
+}
+
+// gitHooksDir returns the directory git runs the hooks of repo from: the
+// core.hooksPath set in the repository's own config, relative to the working
+// tree at dir, or the hooks directory shared by its worktrees. A global
+// core.hooksPath is left alone, lipstick install --global chains to the
+// repository's hooks from there.
+func gitHooksDir(repo *git.Repository, dir string) (string, error) {
+	local, err := git.ReadConfig(filepath.Join(repo.CommonDir, "config"))
+	if err != nil {
+		return "", err
+	}
+	p, err := expandHome(local.Get("core.hooksPath"))
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case p == "":
+		return filepath.Join(repo.CommonDir, "hooks"), nil
+	case filepath.IsAbs(p):
+		return p, nil
+	}
+	return filepath.Join(dir, p), nil
+}
+
+// expandHome replaces a leading ~/ in a path from git config with the home
+// directory, as git does.
+func expandHome(p string) (string, error) {
+	if !strings.HasPrefix(p, "~/") {
+		return p, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, p[2:]), nil
+}
+
+func isDir(p string) bool {
+	fi, err := os.Stat(p)
+	return err == nil && fi.IsDir()
+}
+
+// removeHook strips every piece of text from the file at path. A missing
+// file is not an error.
+func removeHook(path string, pieces ...string) error {
+	d, err := readFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	out := string(d)
+	for _, p := range pieces {
+		out = strings.Replace(out, p, "", -1)
+	}
+	if out == string(d) {
+		return nil
+	}
+	return writeFile(path, out)
+}
+
+// Hooks are chained through a dispatcher: the hook itself runs every
+// executable in <hook>.d/ in name order and stops at the first failure. The
+// entries carry ordering prefixes so a hook that was there before lipstick
+// runs first for every hook name, and other scripts can be slotted in
+// between.
+const (
+	dispatcherMarker = "# lipstick hook dispatcher"
+	lipstickEntry    = "50-lipstick"
+
+	// oldLipstickEntry is the entry older versions installed without a prefix.
+	oldLipstickEntry = "lipstick"
+)
+
+// originalEntry names the hook that was there before lipstick inside
+// <hook>.d. It ends in the hook name so scripts that look at $0 still work.
+func originalEntry(name string) string {
+	return "00-" + name
+}
+
+// legacyHook holds the lines older versions of lipstick appended to hooks.
+var legacyHook = []string{
+	"\n# simplifies emoji usage \nlipstick \"`cat $1`\" > \"$1\"",
+	"\n# records lipstick notes \nlipstick note",
+}
+
+func dispatcherScript(name string) string {
+	return "#!/bin/sh\n" + dispatcherMarker + "\n" +
+		"# Runs every executable in " + name + ".d in name order.\n" +
+		"for hook in \"$0.d\"/*; do\n" +
+		"\tif [ -f \"$hook\" ] && [ -x \"$hook\" ]; then\n" +
+		"\t\t\"$hook\" \"$@\" || exit $?\n" +
+		"\tfi\n" +
+		"done\n"
+}
+
+func isDispatcher(path string) bool {
+	d, err := readFile(path)
+	return err == nil && strings.Contains(string(d), dispatcherMarker)
+}
+
+// installChained adds body as lipstick's entry for the hook name, turning
+// the hook into a dispatcher and moving any existing hook aside first.
+func installChained(hooksDir, name, body string) error {
+	path := filepath.Join(hooksDir, name)
+	dir := path + ".d"
+	if err := mkdirAll(dir); err != nil {
+		return err
+	}
+	if !isDispatcher(path) {
+		if err := removeHook(path, legacyHook...); err != nil {
+			return err
+		}
+		d, err := readFile(path)
+		switch {
+		case os.IsNotExist(err):
+		case err != nil:
+			return err
+		case strings.TrimSpace(string(d)) == "":
+			// Only an older lipstick install was left in it.
+			if err := removeFile(path); err != nil {
+				return err
+			}
+		default:
+			if err := renameFile(path, filepath.Join(dir, originalEntry(name))); err != nil {
+				return err
+			}
+		}
+		if err := writeHook(path, dispatcherScript(name)); err != nil {
+			return err
+		}
+	} else if err := renameEntries(dir, name); err != nil {
+		return err
+	}
+	return writeHook(filepath.Join(dir, lipstickEntry), "#!/bin/sh\n"+body)
+}
+
+// renameEntries moves the entries of an older install without prefixes to
+// their current names, so the hook is not run twice after upgrading.
+func renameEntries(dir, name string) error {
+	if err := removeFile(filepath.Join(dir, oldLipstickEntry)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	old := filepath.Join(dir, name)
+	if _, err := readFile(old); os.IsNotExist(err) {
+		return nil
+	}
+	if _, err := readFile(filepath.Join(dir, originalEntry(name))); err == nil {
+		// Both exist, leave them for the user to sort out.
+		return nil
+	}
+	return renameFile(old, filepath.Join(dir, originalEntry(name)))
+}
+
+// uninstallChained removes lipstick's entry for the hook name. When only the
+// original hook is left it is moved back, leaving things as they were before
+// install.
+func uninstallChained(hooksDir, name string) error {
+	path := filepath.Join(hooksDir, name)
+	dir := path + ".d"
+	if !isDispatcher(path) {
+		return removeHook(path, legacyHook...)
+	}
+	for _, entry := range []string{lipstickEntry, oldLipstickEntry} {
+		if err := removeFile(filepath.Join(dir, entry)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	entries, err := readDirNames(dir)
+	if err != nil {
+		return err
+	}
+	switch {
+	case len(entries) == 0:
+		if err := removeFile(path); err != nil {
+			return err
+		}
+	case len(entries) == 1 && (entries[0] == originalEntry(name) || entries[0] == name):
+		if err := renameFile(filepath.Join(dir, entries[0]), path); err != nil {
+			return err
+		}
+	default:
+		// Other hooks were added to the directory, keep dispatching.
+		return nil
+	}
+	return removeAll(dir)
+}
+
+// gitVCS installs lipstick as a git commit-msg hook.
+type gitVCS struct {
+	hooksDir string
+}
+
+func (g gitVCS) name() string { return "git" }
+
+func (g gitVCS) install(cfg *Config) error {
+	if err := installChained(g.hooksDir, "commit-msg", hook); err != nil {
+		return fmt.Errorf("unable to create the commit-msg hook: %v", err)
+	}
+	// Notes can only be attached once the commit exists, so notes mode
+	// needs a post-commit hook as well.
+	if cfg.Output.mode() == modeNotes {
+		if err := installChained(g.hooksDir, "post-commit", noteHook); err != nil {
+			return fmt.Errorf("unable to create the post-commit hook: %v", err)
+		}
+	}
+	if hasTemplates(cfg) {
+		if err := installChained(g.hooksDir, "prepare-commit-msg", prepareHook); err != nil {
+			return fmt.Errorf("unable to create the prepare-commit-msg hook: %v", err)
+		}
+	}
+	return nil
+}
+
+func (g gitVCS) uninstall() error {
+	if err := uninstallChained(g.hooksDir, "commit-msg"); err != nil {
+		return fmt.Errorf("unable to remove commit-msg hook: %v", err)
+	}
+	if err := uninstallChained(g.hooksDir, "post-commit"); err != nil {
+		return fmt.Errorf("unable to remove post-commit hook: %v", err)
+	}
+	if err := uninstallChained(g.hooksDir, "prepare-commit-msg"); err != nil {
+		return fmt.Errorf("unable to remove prepare-commit-msg hook: %v", err)
+	}
+	return nil
+}
+
+func (g gitVCS) status() (bool, string, error) {
+	path := filepath.Join(g.hooksDir, "commit-msg")
+	entry := filepath.Join(path+".d", lipstickEntry)
+	if isDispatcher(path) {
+		if _, err := readFile(entry); err != nil {
+			old := filepath.Join(path+".d", oldLipstickEntry)
+			if _, err := readFile(old); err == nil {
+				return true, old, nil
+			}
+			return false, entry, nil
+		}
+		return true, entry, nil
+	}
+	d, err := readFile(path)
+	if os.IsNotExist(err) {
+		return false, path, nil
+	} else if err != nil {
+		return false, path, err
+	}
+	return strings.Contains(string(d), "\nlipstick "), path, nil
+}
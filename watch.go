@@ -0,0 +1,191 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// configEvent is sent to subscribers after every reload attempt. Err is set
+// when the config files changed but could not be loaded, in which case
+// Config is still the last good config.
+type configEvent struct {
+	Config *Config
+	Err    error
+}
+
+// fileStamp is what the watcher compares to notice a change.
+type fileStamp struct {
+	exists  bool
+	size    int64
+	modTime time.Time
+}
+
+func stampFile(path string) fileStamp {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{true, fi.Size(), fi.ModTime()}
+}
+
+// configManager keeps the config of long running modes up to date. Readers
+// get the current config without locking, reloads swap it in whole.
+type configManager struct {
+	current atomic.Value // *Config
+
+	dir    string
+	mu     sync.Mutex
+	stamps map[string]fileStamp
+	err    error
+	subs   []chan configEvent
+}
+
+// configFiles returns the files cfg was resolved from, including local
+// config files that do not exist yet so their creation is noticed. Files
+// read from git are left out, they only change with the ref.
+func configFiles(cfg *Config) []string {
+	files := localConfigPaths(cfg.Dir)
+	for _, f := range cfg.Files {
+		if f != builtinSource && !strings.HasPrefix(f, gitPrefix) {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// loadConfig loads the config files in dir, falling back on the builtin
+// config when there are none. A config file that exists but does not decode
+// is an error instead of a reason to fall back.
+func loadConfig(dir string) (*Config, error) {
+	cfg, err := readLocalConfig(dir)
+	if err == errNoLocalConfig {
+		cfg, err = loadDefaultConfig(&Config{})
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := checkPolicy(cfg.Policy); err != nil {
+		return nil, err
+	}
+	if err := checkTables(cfg.Tables); err != nil {
+		return nil, err
+	}
+	cfg.Dir = dir
+	cfg.indexKeys()
+	return cfg, nil
+}
+
+// newConfigManager loads the config of dir for the first time.
+func newConfigManager(dir string) (*configManager, error) {
+	cfg, err := loadConfig(dir)
+	if err != nil {
+		return nil, err
+	}
+	m := &configManager{dir: dir, stamps: stampAll(configFiles(cfg))}
+	m.current.Store(cfg)
+	return m, nil
+}
+
+func stampAll(files []string) map[string]fileStamp {
+	stamps := map[string]fileStamp{}
+	for _, path := range files {
+		stamps[path] = stampFile(path)
+	}
+	return stamps
+}
+
+// Config returns the last config that loaded successfully.
+func (m *configManager) Config() *Config {
+	return m.current.Load().(*Config)
+}
+
+// Err returns the error of the last reload, nil once a reload succeeds.
+func (m *configManager) Err() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err
+}
+
+// Subscribe returns a channel that receives an event after each reload.
+// Slow subscribers only see the latest event.
+func (m *configManager) Subscribe() <-chan configEvent {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ch := make(chan configEvent, 1)
+	m.subs = append(m.subs, ch)
+	return ch
+}
+
+// Unsubscribe stops events going to ch and closes it.
+func (m *configManager) Unsubscribe(ch <-chan configEvent) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, sub := range m.subs {
+		if sub == ch {
+			m.subs = append(m.subs[:i], m.subs[i+1:]...)
+			close(sub)
+			return
+		}
+	}
+}
+
+// Reload loads the config again if any of its files changed and reports
+// whether it did. On failure the last good config stays in place.
+func (m *configManager) Reload() (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stamps := stampAll(configFiles(m.Config()))
+	changed := false
+	for path, s := range stamps {
+		if m.stamps[path] != s {
+			changed = true
+		}
+	}
+	if !changed {
+		return false, nil
+	}
+	m.stamps = stamps
+	cfg, err := loadConfig(m.dir)
+	if err == nil {
+		m.current.Store(cfg)
+		// Start watching files the new config extends.
+		for _, path := range configFiles(cfg) {
+			if _, ok := stamps[path]; !ok {
+				stamps[path] = stampFile(path)
+			}
+		}
+	}
+	m.err = err
+	ev := configEvent{m.Config(), err}
+	for _, sub := range m.subs {
+		select {
+		case <-sub:
+		default:
+		}
+		sub <- ev
+	}
+	return err == nil, err
+}
+
+// Watch polls the config files every interval until stop is closed,
+// logging reloads and reload errors.
+func (m *configManager) Watch(interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			if ok, err := m.Reload(); err != nil {
+				log.Println("error: could not reload config, keeping the previous one:", err)
+			} else if ok {
+				log.Println("reloaded config")
+			}
+		}
+	}
+}